@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
-	"net/url"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/charmbracelet/log"
 
@@ -13,38 +18,153 @@ import (
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
-const (
-	socketName = "plexhost"
-)
-
 func main() {
-	directory := flag.String("directory", "/live", "The folder where data from live servers are stored")
+	defaults := driver.DefaultConfig()
+
+	configPath := flag.String("config", os.Getenv("CONFIG"), "JSON or YAML config file. Environment variables and flags override it")
+	endpoint := flag.String("endpoint", "", "Storage endpoint, the scheme picks the backend: "+strings.Join(storage.Schemes(), ", "))
+	directory := flag.String("directory", defaults.Directory, "The folder where data from live servers are stored")
+	stateFile := flag.String("state-file", defaults.StateFile, "Name of the file in the directory the volumes are saved in")
+	socket := flag.String("socket", defaults.Socket, "Name of the plugin socket")
+	syncPeriod := flag.Duration("sync-period", defaults.SyncPeriod, "How often mounted volumes are synced")
+	maxConcurrentSyncs := flag.Int("max-concurrent-syncs", defaults.MaxConcurrentSyncs, "How many volumes are compressed and uploaded at once")
+	shutdownTimeout := flag.Duration("shutdown-timeout", defaults.ShutdownTimeout, "How long to wait for mounted volumes to be flushed on shutdown")
+	logLevel := flag.String("log-level", defaults.LogLevel, "One of debug, info, warn, error and fatal")
+	exclude := flag.String("exclude", "", "Comma separated gitignore style patterns to leave out of every volume")
+	include := flag.String("include", "", "Comma separated gitignore style patterns to keep in every volume, even if excluded")
+	retryAttempts := flag.Int("retry-attempts", defaults.RetryAttempts, "How often a failed storage operation is tried in total")
+	retryDelay := flag.Duration("retry-delay", defaults.RetryDelay, "Wait before the first retry, doubled with every retry")
+	retryMaxDelay := flag.Duration("retry-max-delay", defaults.RetryMaxDelay, "Longest wait between retries")
+	attemptTimeout := flag.Duration("attempt-timeout", defaults.AttemptTimeout, "Time limit of a single storage attempt to connect and respond, 0 for none")
+	offlineMount := flag.String("offline-mount", defaults.OfflineMount, "never, or if_synced to mount the local data when storage is unavailable")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve expvar metrics on /debug/vars, e.g. 127.0.0.1:9090")
 	flag.Parse()
 
-	endpoint := os.Getenv("ENDPOINT")
-	if endpoint == "" {
-		log.Fatal("endpoint cannot be empty")
+	// The config file and environment are read again on SIGHUP, flags given
+	// on the command line keep overriding them
+	loadConfig := func() (driver.Config, error) {
+		cfg, err := driver.LoadConfig(*configPath)
+		if err != nil {
+			return cfg, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "endpoint":
+				cfg.Endpoint = *endpoint
+			case "directory":
+				cfg.Directory = *directory
+			case "state-file":
+				cfg.StateFile = *stateFile
+			case "socket":
+				cfg.Socket = *socket
+			case "sync-period":
+				cfg.SyncPeriod = *syncPeriod
+			case "max-concurrent-syncs":
+				cfg.MaxConcurrentSyncs = *maxConcurrentSyncs
+			case "shutdown-timeout":
+				cfg.ShutdownTimeout = *shutdownTimeout
+			case "log-level":
+				cfg.LogLevel = *logLevel
+			case "exclude":
+				cfg.Exclude = driver.SplitList(*exclude)
+			case "include":
+				cfg.Include = driver.SplitList(*include)
+			case "retry-attempts":
+				cfg.RetryAttempts = *retryAttempts
+			case "retry-delay":
+				cfg.RetryDelay = *retryDelay
+			case "retry-max-delay":
+				cfg.RetryMaxDelay = *retryMaxDelay
+			case "attempt-timeout":
+				cfg.AttemptTimeout = *attemptTimeout
+			case "offline-mount":
+				cfg.OfflineMount = *offlineMount
+			case "metrics-addr":
+				cfg.MetricsAddr = *metricsAddr
+			}
+		})
+		return cfg, nil
 	}
 
-	if err := os.MkdirAll(*directory, 0755); err != nil {
-		log.Fatal(err)
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config", "error", err)
 	}
 
-	if _, err := url.ParseRequestURI(endpoint); err != nil {
+	if err := cfg.Validate(); err != nil {
+		log.Fatal("Invalid config", "error", err)
+	}
+	log.SetLevel(cfg.Level())
+	log.Info("Effective config", append(cfg.Fields(), "config", *configPath)...)
+
+	if err := os.MkdirAll(cfg.Directory, 0755); err != nil {
 		log.Fatal(err)
 	}
 
-	store, err := storage.NewHTTPStorage(endpoint)
+	store, err := cfg.OpenStore(cfg.Endpoint)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Failed to open storage", "error", err)
+	}
+
+	if cfg.MetricsAddr != "" {
+		metricsAddr := cfg.MetricsAddr
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/debug/vars", expvar.Handler())
+			log.Info("Serving metrics", "addr", metricsAddr)
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				log.Error("Failed to serve metrics", "error", err)
+			}
+		}()
 	}
 
-	d := driver.NewPlexVolumeDriver(*directory, store)
+	d, err := driver.NewPlexVolumeDriver(cfg, store)
+	if err != nil {
+		log.Fatal(err)
+	}
 	h := volume.NewHandler(d)
 
 	log.Info("Starting Plex volume driver...")
 
-	if err := h.ServeUnix(socketName, 0); err != nil {
-		log.Fatal("Failed to serve unix", "error", err)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	serveErr := make(chan error, 1)
+	socketName := cfg.Socket
+	go func() {
+		serveErr <- h.ServeUnix(socketName, 0)
+	}()
+
+	for running := true; running; {
+		select {
+		case err := <-serveErr:
+			log.Fatal("Failed to serve unix", "error", err)
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				log.Info("Received signal, shutting down", "signal", sig, "timeout", cfg.ShutdownTimeout)
+				running = false
+				break
+			}
+			log.Info("Received SIGHUP, reloading config")
+			newCfg, err := loadConfig()
+			if err != nil {
+				log.Error("Failed to reload config, keeping the current one", "error", err)
+				break
+			}
+			if err := d.Reload(newCfg); err != nil {
+				log.Error("Config was not fully applied", "error", err)
+			}
+			cfg = d.Config()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := d.Shutdown(ctx); err != nil {
+		log.Error("Not all volumes were flushed", "error", err)
+		cancel()
+		os.Exit(1)
 	}
+	log.Info("All volumes flushed, bye")
 }
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand/v2"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/plexyhost/volume-driver/storage"
 )
 
+// chunkDir is where chunks of chunked backups are kept.
+const chunkDir = "chunks"
+
+// archiveSuffix is appended to the server id for the archive file name.
+const archiveSuffix = ".plex"
+
+func chunkPath(sum string) string {
+	return filepath.Join(chunkDir, sum)
+}
+
 // Function to handle file cleanup after the upload is complete
 func finalizeFile(tempFilePath, finalFilePath string) error {
 	// Rename the temporary file to the final file name
@@ -30,13 +44,27 @@ func main() {
 		log.Info("INIT STORAGE->DRIVER", "id", id)
 		start := time.Now()
 
-		f, err := os.Open(id + ".plex")
+		f, err := os.Open(id + archiveSuffix)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
 		defer f.Close()
 
+		fi, err := f.Stat()
+		if err != nil {
+			log.Error("Occured an error under STORAGE->DRIVER", "id", id, "error", err)
+			http.Error(w, "Could not read the archive", http.StatusInternalServerError)
+			return
+		}
+		etag := archiveETag(id, fi)
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			log.Info("NOT MODIFIED STORAGE->DRIVER", "id", id)
+			return
+		}
+
 		w.Header().Add("Content-Type", "binary/octet-stream")
 		w.WriteHeader(http.StatusOK)
 		n, err := f.WriteTo(w)
@@ -53,7 +81,7 @@ func main() {
 		log.Info("INIT DRIVER->STORAGE", "id", id)
 		start := time.Now()
 
-		fn := id + ".plex"
+		fn := id + archiveSuffix
 		tf := strconv.Itoa(rand.IntN(512)) + ".bin"
 
 		outFile, err := os.OpenFile(tf, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -65,7 +93,8 @@ func main() {
 		defer outFile.Close()
 
 		// Read the incoming file data from the request body and write it to the temporary file
-		n, err := io.Copy(outFile, r.Body)
+		cw := storage.NewChecksumWriter(outFile)
+		n, err := io.Copy(cw, r.Body)
 		if err != nil {
 			log.Info("Failed to save chunk", "id", id, "error", err)
 			http.Error(w, "Failed to save file chunk", http.StatusInternalServerError)
@@ -81,18 +110,206 @@ func main() {
 			return
 		}
 
+		if err := storage.WriteChecksum(fn, cw.Sum()); err != nil {
+			log.Error("Failed to save checksum", "id", id, "error", err)
+		}
+
 		// Respond with success
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("File uploaded and saved successfully"))
 		log.Info("COMPLETED DRIVER->STORAGE", "id", id, "bytes_read", byteCount(n), "took", time.Since(start))
 	})
 
+	m.HandleFunc("HEAD /data/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		fi, err := os.Stat(id + archiveSuffix)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		obj := storage.FileObject(id, id+archiveSuffix, fi)
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+		w.Header().Set("Last-Modified", obj.ModTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"`+obj.Version+`"`)
+		if obj.Checksum != "" {
+			w.Header().Set("X-Checksum-Sha256", obj.Checksum)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	m.HandleFunc("DELETE /data/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := os.Remove(id + archiveSuffix); err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			log.Error("Failed to delete archive", "id", id, "error", err)
+			http.Error(w, "Failed to delete the archive", http.StatusInternalServerError)
+			return
+		}
+		if err := os.Remove(id + archiveSuffix + storage.ChecksumSuffix); err != nil && !os.IsNotExist(err) {
+			log.Warn("Failed to delete checksum", "id", id, "error", err)
+		}
+		log.Info("Deleted archive", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	m.HandleFunc("GET /data", func(w http.ResponseWriter, r *http.Request) {
+		objs, err := listArchives()
+		if err != nil {
+			log.Error("Failed to list archives", "error", err)
+			http.Error(w, "Failed to list archives", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(objs)
+	})
+
+	m.HandleFunc("HEAD /chunks/{sum}", func(w http.ResponseWriter, r *http.Request) {
+		sum := r.PathValue("sum")
+		if !storage.ValidChunkSum(sum) {
+			http.Error(w, "Invalid chunk sum", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := os.Stat(chunkPath(sum)); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	m.HandleFunc("GET /chunks/{sum}", func(w http.ResponseWriter, r *http.Request) {
+		sum := r.PathValue("sum")
+		if !storage.ValidChunkSum(sum) {
+			http.Error(w, "Invalid chunk sum", http.StatusBadRequest)
+			return
+		}
+
+		f, err := os.Open(chunkPath(sum))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Add("Content-Type", "binary/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		if _, err := f.WriteTo(w); err != nil {
+			log.Error("Occured an error while sending chunk", "sum", sum, "error", err)
+		}
+	})
+
+	m.HandleFunc("PUT /chunks/{sum}", func(w http.ResponseWriter, r *http.Request) {
+		sum := r.PathValue("sum")
+		if !storage.ValidChunkSum(sum) {
+			http.Error(w, "Invalid chunk sum", http.StatusBadRequest)
+			return
+		}
+
+		if err := os.MkdirAll(chunkDir, 0755); err != nil {
+			log.Error("Failed to create chunk directory", "error", err)
+			http.Error(w, "Could not create chunk directory", http.StatusInternalServerError)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, storage.MaxChunkSize))
+		if err != nil {
+			log.Error("Failed to read chunk", "sum", sum, "error", err)
+			http.Error(w, "Failed to read chunk", http.StatusBadRequest)
+			return
+		}
+		// Chunks we have are never uploaded again, so a damaged one would
+		// break every snapshot using it
+		if err := storage.VerifyChunk(sum, data); err != nil {
+			log.Warn("Rejected damaged chunk", "sum", sum, "error", err)
+			http.Error(w, "Chunk doesn't match its sum", http.StatusBadRequest)
+			return
+		}
+
+		// Chunks are immutable, so there is nothing to do if we already have
+		// it, unless ours is damaged
+		if existing, err := os.ReadFile(chunkPath(sum)); err == nil {
+			if storage.VerifyChunk(sum, existing) == nil {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			log.Warn("Replacing damaged chunk", "sum", sum)
+		}
+
+		tf, err := os.CreateTemp(chunkDir, sum+".*.tmp")
+		if err != nil {
+			log.Error("Failed to create chunk", "sum", sum, "error", err)
+			http.Error(w, "Could not create temporary file", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tf.Name())
+
+		_, err = tf.Write(data)
+		if cerr := tf.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Error("Failed to save chunk", "sum", sum, "error", err)
+			http.Error(w, "Failed to save chunk", http.StatusInternalServerError)
+			return
+		}
+
+		if err := finalizeFile(tf.Name(), chunkPath(sum)); err != nil {
+			log.Error("Failed to finalize chunk", "sum", sum, "error", err)
+			http.Error(w, "Failed to finalize the chunk", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
 	err := http.ListenAndServe(":3000", m)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// archiveETag is the ETag of an archive, its quoted version.
+func archiveETag(id string, fi os.FileInfo) string {
+	return `"` + storage.FileObject(id, id+archiveSuffix, fi).Version + `"`
+}
+
+// etagMatch reports whether the If-None-Match header matches etag. Weak
+// comparison is used, as RFC 9110 asks for If-None-Match.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// listArchives describes every archive in the working directory.
+func listArchives() ([]storage.Object, error) {
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+
+	objs := []storage.Object{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), archiveSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		objs = append(objs, storage.FileObject(id, e.Name(), fi))
+	}
+	return objs, nil
+}
+
 func byteCount(b int64) string {
 	const unit = 1000
 	if b < unit {
@@ -0,0 +1,177 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/plexyhost/volume-driver/pkg/chunker"
+	"github.com/plexyhost/volume-driver/pkg/compression"
+	"github.com/plexyhost/volume-driver/storage"
+)
+
+// chunkStoreFor returns the provider of v, if it supports chunked backups.
+func (d *PlexVolumeDriver) chunkStoreFor(v *volumeInfo) (storage.ChunkProvider, error) {
+	store, err := d.storeFor(v)
+	if err != nil {
+		return nil, err
+	}
+	cs, ok := store.(storage.ChunkProvider)
+	if !ok {
+		return nil, fmt.Errorf("volume %s: storage backend doesn't support chunked mode", v.Name)
+	}
+	return cs, nil
+}
+
+// snapshotPath is where the last snapshot of v is cached, so unchanged files
+// don't have to be chunked again.
+func (d *PlexVolumeDriver) snapshotPath(v *volumeInfo) string {
+	return d.statePath(manifestDir, v.Name+".snapshot")
+}
+
+func (d *PlexVolumeDriver) lastSnapshot(v *volumeInfo) *chunker.Snapshot {
+	f, err := os.Open(d.snapshotPath(v))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("Failed to open snapshot", "name", v.Name, "error", err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	snap, err := chunker.ReadSnapshot(f)
+	if err != nil {
+		log.Warn("Failed to read snapshot", "name", v.Name, "error", err)
+		return nil
+	}
+	return snap
+}
+
+func (d *PlexVolumeDriver) saveSnapshot(v *volumeInfo, snap *chunker.Snapshot) error {
+	path := d.snapshotPath(v)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := snap.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// saveChunked uploads the chunks of v the store doesn't have, and then
+// commits the snapshot under the server id.
+func (d *PlexVolumeDriver) saveChunked(ctx context.Context, vol *volumeInfo) error {
+	store, err := d.chunkStoreFor(vol)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+
+	opts := d.compressOptionsFor(vol)
+	src, staged, done, err := d.archiveSource(vol, opts)
+	if err != nil {
+		log.Errorf("Error while staging %s: %s", vol.ServerID, err)
+		return err
+	}
+	defer done()
+
+	snap, stats, err := chunker.Backup(src, store, chunker.BackupOptions{
+		Exclude:  opts.Excluded,
+		Previous: d.lastSnapshot(vol),
+	})
+	if err != nil {
+		log.Errorf("Error while chunking %s: %s", vol.ServerID, err)
+		return err
+	}
+	stats.SkippedFiles += staged.SkippedFiles
+	stats.SkippedBytes += staged.SkippedBytes
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		return err
+	}
+	// A bytes.Reader can be rewound, so the upload can be retried
+	if err := store.Store(ctx, vol.ServerID, bytes.NewReader(buf.Bytes())); err != nil {
+		log.Errorf("Error while storing snapshot of %s: %s", vol.ServerID, err)
+		return err
+	}
+
+	if err := d.saveSnapshot(vol, snap); err != nil {
+		log.Warn("Failed to cache snapshot", "name", vol.Name, "error", err)
+	}
+
+	log.Info("Stored snapshot", "id", vol.ServerID, "files", stats.Files, "reused_files", stats.ReusedFiles,
+		"chunks", stats.Chunks, "uploaded_chunks", stats.UploadedChunks, "uploaded_bytes", stats.UploadedBytes,
+		"skipped_files", stats.SkippedFiles, "skipped_bytes", stats.SkippedBytes, "took", time.Since(start))
+	return nil
+}
+
+// loadChunked fetches the snapshot of v and reassembles the volume from it.
+func (d *PlexVolumeDriver) loadChunked(ctx context.Context, vol *volumeInfo) error {
+	store, err := d.chunkStoreFor(vol)
+	if err != nil {
+		return err
+	}
+	known := d.knownVersion(vol)
+	start := time.Now()
+
+	var buf bytes.Buffer
+	version, err := storage.RetrieveIfChanged(ctx, store, vol.ServerID, known, &buf)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if errors.Is(err, storage.ErrNotModified) {
+		log.Info("Snapshot unchanged, keeping the local data", "id", vol.ServerID, "version", known)
+		d.markRestored(vol, known)
+		return nil
+	}
+	if err != nil {
+		log.Errorf("Error while retrieving snapshot of %s: %s", vol.ServerID, err)
+		return err
+	}
+
+	snap, err := chunker.ReadSnapshot(&buf)
+	if err != nil {
+		err = corrupt(vol, err)
+		log.Errorf("Error while reading snapshot of %s: %s", vol.ServerID, err)
+		return err
+	}
+
+	err = compression.Replace(vol.Mountpoint, d.statePath(restoreDir), func(staging string) error {
+		return chunker.Restore(snap, store, staging, compression.DecompressOptions{
+			UIDMap:   vol.Options.UIDMap,
+			GIDMap:   vol.Options.GIDMap,
+			MaxBytes: vol.Options.MaxRestoreBytes,
+			MaxFiles: vol.Options.MaxRestoreFiles,
+		})
+	})
+	if errors.Is(err, chunker.ErrCorrupt) {
+		err = corrupt(vol, err)
+	}
+	if err != nil {
+		log.Errorf("Error while restoring %s: %s", vol.ServerID, err)
+		return err
+	}
+
+	if err := d.saveSnapshot(vol, snap); err != nil {
+		log.Warn("Failed to cache snapshot", "name", vol.Name, "error", err)
+	}
+
+	log.Info("Restored snapshot", "id", vol.ServerID, "files", len(snap.Files), "took", time.Since(start))
+	d.markRestored(vol, version)
+	return nil
+}
@@ -0,0 +1,254 @@
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/plexyhost/volume-driver/pkg/ignore"
+	"github.com/plexyhost/volume-driver/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the driver wide configuration. It's loaded from a JSON or YAML
+// file, the environment and flags, in that order, see LoadConfig.
+type Config struct {
+	// Endpoint is the default storage endpoint, see storage.Open
+	Endpoint string `yaml:"endpoint"`
+	// Directory is where the volumes and the driver state are kept
+	Directory string `yaml:"directory"`
+	// StateFile is the name of the file in Directory the volumes are saved in
+	StateFile string `yaml:"state_file"`
+	// Socket is the name of the plugin socket in /run/docker/plugins
+	Socket string `yaml:"socket"`
+	// SyncPeriod is how often mounted volumes are synced, unless a volume
+	// sets its own sync_interval
+	SyncPeriod time.Duration `yaml:"sync_period"`
+	// MaxConcurrentSyncs caps how many volumes are compressed and uploaded at
+	// once. Unmounts get a slot before periodic saves.
+	MaxConcurrentSyncs int `yaml:"max_concurrent_syncs"`
+	// ShutdownTimeout bounds the final flush of the mounted volumes
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// LogLevel is one of debug, info, warn, error and fatal
+	LogLevel string `yaml:"log_level"`
+	// Exclude and Include are ignore rules applied to every volume, before
+	// the volume's own rules
+	Exclude []string `yaml:"exclude"`
+	Include []string `yaml:"include"`
+	// RetryAttempts, RetryDelay, RetryMaxDelay and AttemptTimeout configure
+	// the retries of storage operations, see storage.RetryOptions
+	RetryAttempts  int           `yaml:"retry_attempts"`
+	RetryDelay     time.Duration `yaml:"retry_delay"`
+	RetryMaxDelay  time.Duration `yaml:"retry_max_delay"`
+	AttemptTimeout time.Duration `yaml:"attempt_timeout"`
+	// OfflineMount is whether volumes are mounted from their local data when
+	// the storage backend is unavailable, unless a volume sets its own
+	// offline_mount
+	OfflineMount string `yaml:"offline_mount"`
+	// MetricsAddr is where expvar metrics are served on /debug/vars, empty
+	// to not serve them
+	MetricsAddr string `yaml:"metrics_addr"`
+}
+
+// DefaultConfig is what is used for settings that aren't set anywhere.
+func DefaultConfig() Config {
+	return Config{
+		Directory:          "/live",
+		StateFile:          "volumes.json",
+		Socket:             "plexhost",
+		SyncPeriod:         4 * time.Minute,
+		MaxConcurrentSyncs: 2,
+		ShutdownTimeout:    60 * time.Second,
+		LogLevel:           "info",
+		RetryAttempts:      4,
+		RetryDelay:         time.Second,
+		RetryMaxDelay:      30 * time.Second,
+		OfflineMount:       offlineNever,
+	}
+}
+
+// configEnv maps environment variables to the settings they override. Empty
+// variables are ignored, as Docker sets every plugin Env entry.
+var configEnv = []struct {
+	name string
+	set  func(c *Config, val string) error
+}{
+	{"ENDPOINT", func(c *Config, v string) error { c.Endpoint = v; return nil }},
+	{"DIRECTORY", func(c *Config, v string) error { c.Directory = v; return nil }},
+	{"STATE_FILE", func(c *Config, v string) error { c.StateFile = v; return nil }},
+	{"SOCKET", func(c *Config, v string) error { c.Socket = v; return nil }},
+	{"SYNC_PERIOD", func(c *Config, v string) (err error) { c.SyncPeriod, err = time.ParseDuration(v); return }},
+	{"MAX_CONCURRENT_SYNCS", func(c *Config, v string) (err error) { c.MaxConcurrentSyncs, err = strconv.Atoi(v); return }},
+	{"SHUTDOWN_TIMEOUT", func(c *Config, v string) (err error) { c.ShutdownTimeout, err = time.ParseDuration(v); return }},
+	{"LOG_LEVEL", func(c *Config, v string) error { c.LogLevel = v; return nil }},
+	{"EXCLUDE", func(c *Config, v string) error { c.Exclude = SplitList(v); return nil }},
+	{"INCLUDE", func(c *Config, v string) error { c.Include = SplitList(v); return nil }},
+	{"RETRY_ATTEMPTS", func(c *Config, v string) (err error) { c.RetryAttempts, err = strconv.Atoi(v); return }},
+	{"RETRY_DELAY", func(c *Config, v string) (err error) { c.RetryDelay, err = time.ParseDuration(v); return }},
+	{"RETRY_MAX_DELAY", func(c *Config, v string) (err error) { c.RetryMaxDelay, err = time.ParseDuration(v); return }},
+	{"ATTEMPT_TIMEOUT", func(c *Config, v string) (err error) { c.AttemptTimeout, err = time.ParseDuration(v); return }},
+	{"OFFLINE_MOUNT", func(c *Config, v string) error { c.OfflineMount = v; return nil }},
+	{"METRICS_ADDR", func(c *Config, v string) error { c.MetricsAddr = v; return nil }},
+}
+
+// LoadConfig reads the config file at path on top of the defaults, if path
+// isn't empty, and applies the environment on top of that. The result isn't
+// validated, as the caller may still override settings.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("config file: %w", err)
+		}
+		// JSON is valid YAML, so one decoder reads both
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	for _, env := range configEnv {
+		val := strings.TrimSpace(os.Getenv(env.name))
+		if val == "" {
+			continue
+		}
+		if err := env.set(&cfg, val); err != nil {
+			return cfg, fmt.Errorf("invalid %s %q: %w", env.name, val, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Validate checks every setting, so a bad config fails at startup rather
+// than at the first sync.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Endpoint == "" {
+		errs = append(errs, errors.New("endpoint cannot be empty"))
+	} else if err := storage.Check(c.Endpoint); err != nil {
+		errs = append(errs, err)
+	}
+	if !filepath.IsAbs(c.Directory) {
+		errs = append(errs, fmt.Errorf("directory %q must be an absolute path", c.Directory))
+	}
+	if c.StateFile == "" || c.StateFile != filepath.Base(c.StateFile) || strings.HasPrefix(c.StateFile, ".") {
+		errs = append(errs, fmt.Errorf("state file %q must be a plain file name", c.StateFile))
+	}
+	if c.Socket == "" || strings.ContainsAny(c.Socket, `/\`) {
+		errs = append(errs, fmt.Errorf("socket %q must be a plain name", c.Socket))
+	}
+	if c.SyncPeriod < minSyncInterval {
+		errs = append(errs, fmt.Errorf("sync period %s must be at least %s", c.SyncPeriod, minSyncInterval))
+	}
+	if c.MaxConcurrentSyncs < 1 {
+		errs = append(errs, fmt.Errorf("max concurrent syncs %d must be at least 1", c.MaxConcurrentSyncs))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown timeout %s must be positive", c.ShutdownTimeout))
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log level %q: %w", c.LogLevel, err))
+	}
+	if _, err := c.rules(); err != nil {
+		errs = append(errs, fmt.Errorf("ignore rules: %w", err))
+	}
+	if c.RetryAttempts < 1 {
+		errs = append(errs, fmt.Errorf("retry attempts %d must be at least 1", c.RetryAttempts))
+	}
+	if c.RetryDelay <= 0 || c.RetryMaxDelay < c.RetryDelay {
+		errs = append(errs, fmt.Errorf("retry delay %s must be positive and at most the retry max delay %s", c.RetryDelay, c.RetryMaxDelay))
+	}
+	if c.AttemptTimeout < 0 {
+		errs = append(errs, fmt.Errorf("attempt timeout %s can't be negative", c.AttemptTimeout))
+	}
+	if err := checkOfflinePolicy(c.OfflineMount); err != nil {
+		errs = append(errs, fmt.Errorf("offline mount %q: %w", c.OfflineMount, err))
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("metrics address %q: %w", c.MetricsAddr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Level returns the parsed log level. The config must be valid.
+func (c Config) Level() log.Level {
+	lvl, _ := log.ParseLevel(c.LogLevel)
+	return lvl
+}
+
+// Fields returns the settings as key value pairs for logging.
+func (c Config) Fields() []any {
+	return []any{
+		"endpoint", c.Endpoint,
+		"directory", c.Directory,
+		"state_file", c.StateFile,
+		"socket", c.Socket,
+		"sync_period", c.SyncPeriod,
+		"max_concurrent_syncs", c.MaxConcurrentSyncs,
+		"shutdown_timeout", c.ShutdownTimeout,
+		"log_level", c.LogLevel,
+		"exclude", strings.Join(c.Exclude, ","),
+		"include", strings.Join(c.Include, ","),
+		"retry_attempts", c.RetryAttempts,
+		"retry_delay", c.RetryDelay,
+		"retry_max_delay", c.RetryMaxDelay,
+		"attempt_timeout", c.AttemptTimeout,
+		"offline_mount", c.OfflineMount,
+		"metrics_addr", c.MetricsAddr,
+	}
+}
+
+func (c Config) retryOptions() storage.RetryOptions {
+	return storage.RetryOptions{
+		Attempts:       c.RetryAttempts,
+		BaseDelay:      c.RetryDelay,
+		MaxDelay:       c.RetryMaxDelay,
+		AttemptTimeout: c.AttemptTimeout,
+	}
+}
+
+// OpenStore opens the provider for endpoint, retrying its operations as
+// configured.
+func (c Config) OpenStore(endpoint string) (storage.Provider, error) {
+	p, err := storage.Open(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return storage.WithRetry(p, c.retryOptions()), nil
+}
+
+// rules compiles the driver wide ignore rules.
+func (c Config) rules() (*ignore.Matcher, error) {
+	m, err := ignore.New(c.Exclude...)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Include(c.Include...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SplitList splits a comma separated list, dropping empty entries.
+func SplitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -3,50 +3,155 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/plexyhost/volume-driver/pkg/ignore"
 	"github.com/plexyhost/volume-driver/storage"
 )
 
 // mangler i memory ved genstart af driver
 type volumeInfo struct {
+	// Name is the Docker volume name
+	Name     string
 	ServerID string
 	Mounted  bool
+	// Mounts holds the MountRequest.IDs the volume is mounted for. The volume
+	// is only downloaded on the first mount and uploaded on the last unmount.
+	Mounts mountSet `json:",omitempty"`
 
 	// Mountpoint is where the data will be saved locally
 	Mountpoint string
+	// RemoteVersion is the version of the archive last stored or restored,
+	// empty if unknown. Mount skips the download while it's unchanged.
+	RemoteVersion string `json:",omitempty"`
+	// Degraded is set when the volume was mounted from its local data, as
+	// the storage backend was unavailable. It's cleared by the next sync.
+	Degraded bool `json:",omitempty"`
 
+	Options volumeOptions
+
+	// lastSync is when the local data last matched the remote
 	lastSync time.Time
-	ctx      context.Context
-	cancel   context.CancelFunc
+	// skippedSyncs counts the syncs skipped because nothing changed
+	skippedSyncs int
+	// synced is the manifest of the last sync, see lastManifest
+	synced manifest
+	ctx    context.Context
+	cancel context.CancelFunc
+	// store is the provider from Options.Backend, if set
+	store storage.Provider
+	// pending is when the upload in the queue was archived, zero if none is
+	// queued
+	pending time.Time
+
+	// opMu serializes everything touching the data of the volume: restores,
+	// saves and removal. It is held for the whole operation.
+	opMu sync.Mutex
+	// mu guards state, Mounted, Mounts, RemoteVersion, Degraded, store and
+	// pending. It is only held briefly, so Get and List never wait for a
+	// sync.
+	mu    sync.Mutex
+	state volumeState
+}
+
+// legacyMountID is used for volumes that were mounted before mounts were
+// tracked by id. The container that mounted it may still be running, so it's
+// kept until an unmount with an id that isn't tracked consumes it.
+const legacyMountID = ""
+
+// mountSet is a set of mount ids. Docker mounts a volume once per container,
+// and mounts it again with the same id after a crash or reboot, as it
+// doesn't know the driver still has it mounted, so ids aren't counted.
+type mountSet map[string]struct{}
+
+func (m mountSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(slices.Sorted(maps.Keys(m)))
+}
+
+func (m *mountSet) UnmarshalJSON(data []byte) error {
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+	*m = make(mountSet, len(ids))
+	for _, id := range ids {
+		(*m)[id] = struct{}{}
+	}
+	return nil
 }
 
 type PlexVolumeDriver struct {
+	// Volumes, closing and the settings that can be reloaded are guarded by
+	// mutex. The volumes themselves have their own locks.
 	Volumes        map[string]*volumeInfo
 	mutex          *sync.RWMutex
 	endpoint       string
 	syncPeriod     time.Duration
 	store          storage.Provider
 	volumeInfoPath string
+	// closing is set once Shutdown has been called, new mounts are refused
+	closing bool
+	// fileMu serializes writes of volumes.json
+	fileMu sync.Mutex
+	// ignore holds the driver wide ignore rules
+	ignore *ignore.Matcher
+	// cfg is the config the driver currently runs with
+	cfg Config
+	// reloaded is closed and replaced by Reload, to wake up the periodic
+	// savers
+	reloaded chan struct{}
+	// queueWake wakes up the upload queue, stopQueue stops it
+	queueWake chan struct{}
+	stopQueue context.CancelFunc
+	// sched runs the periodic syncs, slots caps the syncs running at once
+	sched *scheduler
+	slots *slots
 }
 
 func (d *PlexVolumeDriver) saveVolumes() error {
+	d.fileMu.Lock()
+	defer d.fileMu.Unlock()
+
+	// Encode every volume under its own lock
 	d.mutex.RLock()
-	defer d.mutex.RUnlock()
+	vols := make(map[string]json.RawMessage, len(d.Volumes))
+	for name, v := range d.Volumes {
+		v.mu.Lock()
+		data, err := json.Marshal(v)
+		v.mu.Unlock()
+		if err != nil {
+			d.mutex.RUnlock()
+			return err
+		}
+		vols[name] = data
+	}
+	d.mutex.RUnlock()
 
-	file, err := os.Create(filepath.Join(d.endpoint, d.volumeInfoPath))
+	// Write to a temporary file first, so a crash never leaves a truncated file
+	path := filepath.Join(d.endpoint, d.volumeInfoPath)
+	// Only readable by the driver, volume options can hold RCON passwords
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	if err := json.NewEncoder(file).Encode(vols); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
 
-	return json.NewEncoder(file).Encode(d.Volumes)
+	return os.Rename(path+".tmp", path)
 }
 
 func (d *PlexVolumeDriver) loadVolumes() error {
@@ -67,37 +172,102 @@ func (d *PlexVolumeDriver) loadVolumes() error {
 		return err
 	}
 
-	for _, v := range d.Volumes {
+	for name, v := range d.Volumes {
+		// Volumes saved before create options existed are named by server id
+		if v.Name == "" {
+			v.Name = name
+		}
+		if v.Mounted && len(v.Mounts) == 0 {
+			v.Mounts = mountSet{legacyMountID: {}}
+		}
 		v.ctx, v.cancel = context.WithCancel(context.Background())
-		v.lastSync = time.Now()
 		if v.Mounted {
-			go d.startPeriodicSave(v.ctx, v.ServerID)
+			v.state = stateMounted
 		}
 	}
 
 	return nil
 }
 
-func NewPlexVolumeDriver(endpoint string, store storage.Provider) *PlexVolumeDriver {
+func NewPlexVolumeDriver(cfg Config, store storage.Provider) (*PlexVolumeDriver, error) {
+	rules, err := cfg.rules()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ignore rules: %w", err)
+	}
+
+	defaults := DefaultConfig()
+	syncPeriod := cfg.SyncPeriod
+	if syncPeriod == 0 {
+		syncPeriod = defaults.SyncPeriod
+	}
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = defaults.StateFile
+	}
+	if cfg.MaxConcurrentSyncs == 0 {
+		cfg.MaxConcurrentSyncs = defaults.MaxConcurrentSyncs
+	}
+	cfg.SyncPeriod, cfg.StateFile = syncPeriod, stateFile
 
 	driver := &PlexVolumeDriver{
 		Volumes:        make(map[string]*volumeInfo),
 		mutex:          &sync.RWMutex{},
-		endpoint:       endpoint,
-		syncPeriod:     4 * time.Minute,
+		endpoint:       cfg.Directory,
+		syncPeriod:     syncPeriod,
 		store:          store,
-		volumeInfoPath: "volumes.json",
+		volumeInfoPath: stateFile,
+		ignore:         rules,
+		cfg:            cfg,
+		reloaded:       make(chan struct{}),
+		queueWake:      make(chan struct{}, 1),
+		sched:          newScheduler(),
+		slots:          newSlots(cfg.MaxConcurrentSyncs),
 	}
 	if err := driver.loadVolumes(); err != nil {
 		log.Info("Failed to save volumes", "error", err)
 	}
-	return driver
+	driver.sweepRestores()
+
+	// Volumes that were mounted when the driver stopped keep syncing
+	for _, v := range driver.Volumes {
+		if v.Mounted {
+			driver.schedule(v)
+		}
+	}
+
+	driver.clearStaging()
+	driver.loadQueue()
+	ctx, cancel := context.WithCancel(context.Background())
+	driver.stopQueue = cancel
+	go driver.drainQueue(ctx)
+	go driver.runScheduler(ctx)
+	return driver, nil
+}
+
+// volume looks up a volume by its Docker name.
+func (d *PlexVolumeDriver) volume(name string) (*volumeInfo, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	v, exists := d.Volumes[name]
+	if !exists {
+		return nil, fmt.Errorf("volume %s not found", name)
+	}
+	return v, nil
 }
 
-// req.Name __has__ to be the server's id.
+// The server id defaults to req.Name, unless the server_id option is given.
 func (d *PlexVolumeDriver) Create(req *volume.CreateRequest) error {
 
-	log.Info("Creating volume", "name", req.Name)
+	log.Info("Creating volume", "name", req.Name, "options", redactOptions(req.Options))
+
+	if err := d.checkVolumeName(req.Name); err != nil {
+		return err
+	}
+	serverID, opts, err := parseVolumeOptions(req.Name, req.Options)
+	if err != nil {
+		return err
+	}
 
 	mountpoint := filepath.Join(d.endpoint, req.Name)
 	if err := os.MkdirAll(mountpoint, 0755); err != nil {
@@ -105,13 +275,20 @@ func (d *PlexVolumeDriver) Create(req *volume.CreateRequest) error {
 	}
 
 	d.mutex.Lock()
+	if _, exists := d.Volumes[req.Name]; exists {
+		d.mutex.Unlock()
+		log.Info("Volume already exists", "name", req.Name)
+		return nil
+	}
 	volInfo := &volumeInfo{
-		ServerID:   req.Name,
+		Name:       req.Name,
+		ServerID:   serverID,
 		Mountpoint: mountpoint,
 		Mounted:    false,
-		lastSync:   time.Now(),
+		Options:    opts,
 		ctx:        nil,
 		cancel:     nil,
+		state:      stateCreated,
 	}
 	d.Volumes[req.Name] = volInfo
 	d.mutex.Unlock()
@@ -127,15 +304,24 @@ func (d *PlexVolumeDriver) Create(req *volume.CreateRequest) error {
 func (d *PlexVolumeDriver) Remove(req *volume.RemoveRequest) error {
 
 	// Get volume
-	v, exists := d.Volumes[req.Name]
-	if !exists {
-		return fmt.Errorf("volume %s not found", req.Name)
+	v, err := d.volume(req.Name)
+	if err != nil {
+		return err
+	}
+
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+
+	if err := v.transition(stateRemoving); err != nil {
+		return err
 	}
 
 	// Remove data from the disk
 	if err := os.RemoveAll(v.Mountpoint); err != nil {
+		_ = v.transition(stateCreated)
 		return err
 	}
+	d.removeManifest(v)
 
 	// Remove the volume info from d.Volumes
 	d.mutex.Lock()
@@ -151,43 +337,80 @@ func (d *PlexVolumeDriver) Remove(req *volume.RemoveRequest) error {
 }
 
 func (d *PlexVolumeDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
-	d.mutex.RLock()
-	defer d.mutex.RUnlock()
-
-	v, exists := d.Volumes[req.Name]
-	if !exists {
-		return nil, fmt.Errorf("volume %s not found", req.Name)
+	v, err := d.volume(req.Name)
+	if err != nil {
+		return nil, err
 	}
 
 	return &volume.PathResponse{Mountpoint: v.Mountpoint}, nil
 }
 
 func (d *PlexVolumeDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
-	log.Info("Mounting volume", "name", req.Name)
+	log.Info("Mounting volume", "name", req.Name, "id", req.ID)
 
 	// Find volume
-	d.mutex.RLock()
-	v, exists := d.Volumes[req.Name]
-	if !exists {
+	v, err := d.volume(req.Name)
+	if err != nil {
 		log.Warn("Volume not found??")
-		return nil, fmt.Errorf("volume %s not found", req.Name)
+		return nil, err
 	}
-	d.mutex.RUnlock()
 
-	// Load store
-	err := d.loadFromStore(v)
-	if err != nil {
-		return nil, err
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+
+	d.mutex.RLock()
+	closing := d.closing
+	d.mutex.RUnlock()
+	if closing {
+		return nil, fmt.Errorf("volume %s can't be mounted, driver is shutting down", req.Name)
 	}
 
-	// Set mounted and context stuff
-	d.mutex.Lock()
-	v.Mounted = true
-	v.ctx, v.cancel = context.WithCancel(context.Background())
-	d.mutex.Unlock()
+	// Only the first mount loads the volume and starts syncing it
+	if v.currentState() == stateMounted {
+		log.Info("Volume already mounted, skipping download", "name", req.Name)
+	} else {
+		if err := v.transition(stateRestoring); err != nil {
+			return nil, err
+		}
+
+		// The local data is newer than the remote while an upload is queued,
+		// so it's uploaded instead of being replaced by the older archive
+		if v.hasPending() {
+			log.Info("Upload queued, keeping the local data", "name", req.Name)
+			if err := d.uploadPending(context.Background(), v, v.Name, priorityFlush); err != nil {
+				log.Warn("Queued upload failed, mounting anyway", "name", req.Name, "error", err)
+				v.setDegraded(true)
+			}
+		} else if err := d.loadFromStore(context.Background(), v); err != nil {
+			if !d.canMountOffline(v, err) {
+				_ = v.transition(stateCreated)
+				return nil, err
+			}
+			log.Warn("Storage unavailable, mounting the local data", "name", req.Name, "error", err)
+			v.setDegraded(true)
+		} else {
+			v.setDegraded(false)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		v.mu.Lock()
+		v.ctx, v.cancel = ctx, cancel
+		v.mu.Unlock()
+		if err := v.transition(stateMounted); err != nil {
+			cancel()
+			return nil, err
+		}
 
-	// Start background sync for this volume
-	go d.startPeriodicSave(v.ctx, v.ServerID)
+		// Start background sync for this volume
+		d.schedule(v)
+	}
+
+	v.mu.Lock()
+	if v.Mounts == nil {
+		v.Mounts = make(mountSet)
+	}
+	v.Mounts[req.ID] = struct{}{}
+	v.mu.Unlock()
 
 	// Save volumes to disk for persisency
 	if err := d.saveVolumes(); err != nil {
@@ -199,48 +422,181 @@ func (d *PlexVolumeDriver) Mount(req *volume.MountRequest) (*volume.MountRespons
 }
 
 func (d *PlexVolumeDriver) Unmount(req *volume.UnmountRequest) error {
-	log.Info("Unmounting driver...", "name", req.Name)
+	log.Info("Unmounting driver...", "name", req.Name, "id", req.ID)
 
-	d.mutex.RLock()
-	v, exists := d.Volumes[req.Name]
-	if !exists {
-		return fmt.Errorf("volume %s not found", req.Name)
+	v, err := d.volume(req.Name)
+	if err != nil {
+		return err
 	}
-	v.cancel()
-	d.mutex.RUnlock()
 
-	log.Info("Saving volume to store", req.Name)
-	err := d.saveToStore(v)
-	if err != nil {
+	// Waits for any periodic save in progress
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+
+	v.mu.Lock()
+	id := req.ID
+	if _, ok := v.Mounts[id]; !ok {
+		if _, legacy := v.Mounts[legacyMountID]; !legacy {
+			v.mu.Unlock()
+			log.Warn("Unmount of unknown mount id, ignoring", "name", req.Name, "id", id)
+			return nil
+		}
+		id = legacyMountID
+	}
+	delete(v.Mounts, id)
+	remaining := len(v.Mounts)
+	v.mu.Unlock()
+
+	// Other containers are still using the volume, keep syncing
+	if remaining > 0 {
+		log.Info("Volume still mounted elsewhere, skipping upload", "name", req.Name, "mounts", remaining)
+		if err := d.saveVolumes(); err != nil {
+			log.Error("Failed to save volumes", "error", err)
+		}
+		return nil
+	}
+
+	// Last unmount, stop the periodic save and do a final upload
+	if err := v.transition(stateUnmounting); err != nil {
 		return err
 	}
+	v.cancel()
+
+	log.Info("Saving volume to store", "name", req.Name)
+	err = d.saveIfChanged(context.Background(), v, priorityFlush, false)
+	if terr := v.transition(stateCreated); terr != nil {
+		log.Error("Failed to finish unmount", "name", req.Name, "error", terr)
+	}
+
+	// Save volumes to disk for persistency
+	if err := d.saveVolumes(); err != nil {
+		log.Error("Failed to save volumes", "error", err)
+	}
+
+	return err
+}
+
+// Shutdown refuses new mounts, stops every periodic save and does a final
+// upload of all mounted volumes in parallel. It returns when all uploads are
+// done or ctx is done, whichever comes first. Mounts are kept in volumes.json,
+// so syncing resumes when the driver is started again.
+func (d *PlexVolumeDriver) Shutdown(ctx context.Context) error {
+	// Whatever is left in the queue is uploaded on the next start, periodic
+	// syncs are replaced by the flush below
+	d.stopQueue()
 
-	// Cancel context and set mounted to false
 	d.mutex.Lock()
-	v.Mounted = false
+	d.closing = true
+	var mounted []*volumeInfo
+	for _, v := range d.Volumes {
+		v.mu.Lock()
+		if v.Mounted {
+			v.cancel()
+			mounted = append(mounted, v)
+		}
+		v.mu.Unlock()
+	}
 	d.mutex.Unlock()
 
-	// Save volumes to disk for persistency
+	log.Info("Shutting down, flushing mounted volumes", "count", len(mounted))
+
+	errs := make([]error, len(mounted))
+	var wg sync.WaitGroup
+	for i, v := range mounted {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = d.flush(ctx, v)
+		}()
+	}
+	wg.Wait()
+
 	if err := d.saveVolumes(); err != nil {
-		log.Error("Failed to save volumes")
+		log.Error("Failed to save volumes", "error", err)
+		errs = append(errs, err)
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func (d *PlexVolumeDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
-	d.mutex.RLock()
-	defer d.mutex.RUnlock()
+// flush uploads v unless ctx is done first.
+func (d *PlexVolumeDriver) flush(ctx context.Context, v *volumeInfo) error {
+	done := make(chan error, 1)
+	go func() {
+		v.opMu.Lock()
+		defer v.opMu.Unlock()
 
-	v, exists := d.Volumes[req.Name]
-	if !exists {
-		return nil, fmt.Errorf("volume %s not found", req.Name)
+		// Unmounted while waiting, Unmount has done the upload
+		if v.currentState() != stateMounted {
+			done <- nil
+			return
+		}
+		done <- d.sync(ctx, v, priorityFlush)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Error("Failed to flush volume", "name", v.Name, "error", err)
+			return fmt.Errorf("flush %s: %w", v.Name, err)
+		}
+		log.Info("Flushed volume", "name", v.Name)
+		return nil
+	case <-ctx.Done():
+		log.Error("Gave up flushing volume", "name", v.Name, "error", ctx.Err())
+		return fmt.Errorf("flush %s: %w", v.Name, ctx.Err())
+	}
+}
+
+// sync uploads a mounted volume if it changed, quiescing its game server
+// first. The caller must hold v.opMu.
+func (d *PlexVolumeDriver) sync(ctx context.Context, v *volumeInfo, priority int) error {
+	if err := v.transition(stateSyncing); err != nil {
+		return err
+	}
+	defer func() {
+		if err := v.transition(stateMounted); err != nil {
+			log.Error("Failed to finish sync", "name", v.Name, "error", err)
+		}
+	}()
+
+	return d.saveIfChanged(ctx, v, priority, v.Options.RCONHost != "")
+}
+
+// status is what Docker shows as the Status of a volume.
+func (v *volumeInfo) status() map[string]interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	status := map[string]interface{}{
+		"state":         v.state.String(),
+		"server_id":     v.ServerID,
+		"mounts":        len(v.Mounts),
+		"skipped_syncs": v.skippedSyncs,
+	}
+	if !v.lastSync.IsZero() {
+		status["last_sync"] = v.lastSync.Format(time.RFC3339)
+	}
+	if !v.pending.IsZero() {
+		status["pending_upload"] = v.pending.Format(time.RFC3339)
+	}
+	if v.Degraded {
+		status["degraded"] = true
+	}
+	return status
+}
+
+func (d *PlexVolumeDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
+	v, err := d.volume(req.Name)
+	if err != nil {
+		return nil, err
 	}
 
 	return &volume.GetResponse{
 		Volume: &volume.Volume{
-			Name:       v.ServerID,
+			Name:       v.Name,
 			Mountpoint: v.Mountpoint,
+			Status:     v.status(),
 		},
 	}, nil
 }
@@ -252,8 +608,9 @@ func (d *PlexVolumeDriver) List() (*volume.ListResponse, error) {
 	var vols []*volume.Volume
 	for _, v := range d.Volumes {
 		vols = append(vols, &volume.Volume{
-			Name:       v.ServerID,
+			Name:       v.Name,
 			Mountpoint: v.Mountpoint,
+			Status:     v.status(),
 		})
 	}
 	return &volume.ListResponse{Volumes: vols}, nil
@@ -265,31 +622,75 @@ func (d *PlexVolumeDriver) Capabilities() *volume.CapabilitiesResponse {
 	}
 }
 
-func (d *PlexVolumeDriver) startPeriodicSave(ctx context.Context, volumeName string) {
-	ticker := time.NewTicker(d.syncPeriod)
-	defer ticker.Stop()
+// offlinePolicyFor returns the offline mount policy of v, falling back to the
+// driver default.
+func (d *PlexVolumeDriver) offlinePolicyFor(v *volumeInfo) string {
+	if v.Options.OfflineMount != "" {
+		return v.Options.OfflineMount
+	}
+	return d.Config().OfflineMount
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			d.mutex.RLock()
-			v, exists := d.Volumes[volumeName]
-			d.mutex.RUnlock()
+// canMountOffline reports whether v may be mounted from its local data after
+// its restore failed with err. That's only the case if the backend is
+// unavailable, the policy allows it and the local data still is exactly what
+// was last synced, so it's at least as new as the last successful sync.
+func (d *PlexVolumeDriver) canMountOffline(v *volumeInfo, err error) bool {
+	if !storage.Retryable(err) || d.offlinePolicyFor(v) != offlineIfSynced {
+		return false
+	}
+	last := d.lastManifest(v)
+	if last == nil {
+		log.Warn("Volume was never synced, can't mount it offline", "name", v.Name)
+		return false
+	}
+	if !d.currentManifest(v).equal(last) {
+		log.Warn("Local data differs from the last sync, can't mount it offline", "name", v.Name)
+		return false
+	}
+	return true
+}
 
-			if !exists {
-				return
-			}
+// setDegraded marks whether v was mounted without its remote data.
+func (v *volumeInfo) setDegraded(degraded bool) {
+	v.mu.Lock()
+	v.Degraded = degraded
+	v.mu.Unlock()
+}
 
-			log.Debug("Syncing volume", "id", v.ServerID)
+// isDegraded reports whether v was mounted without its remote data.
+func (v *volumeInfo) isDegraded() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.Degraded
+}
 
-			err := d.saveToStore(v)
-			if err != nil {
-				log.Error("Failed to sync volume periodically", "id", v.ServerID, "error", err)
-			}
+// syncPeriodFor returns the sync interval of v, falling back to the driver default.
+func (d *PlexVolumeDriver) syncPeriodFor(v *volumeInfo) time.Duration {
+	if v.Options.SyncInterval > 0 {
+		return v.Options.SyncInterval
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.syncPeriod
+}
 
-		case <-ctx.Done():
-			log.Info("Volume context exceeded, stopping periodic save", "volume", volumeName)
-			return
+// storeFor returns the storage provider of v, falling back to the driver default.
+func (d *PlexVolumeDriver) storeFor(v *volumeInfo) (storage.Provider, error) {
+	if v.Options.Backend == "" {
+		d.mutex.RLock()
+		defer d.mutex.RUnlock()
+		return d.store, nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.store == nil {
+		store, err := d.Config().OpenStore(v.Options.Backend)
+		if err != nil {
+			return nil, err
 		}
+		v.store = store
 	}
+	return v.store, nil
 }
@@ -0,0 +1,102 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/plexyhost/volume-driver/storage"
+)
+
+func TestLegacyMount(t *testing.T) {
+	dir := t.TempDir()
+	mountpoint := filepath.Join(dir, "vol")
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mountpoint, "level.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Mounted by a container before mounts were tracked by id
+	state := fmt.Sprintf(`{"vol":{"ServerID":"vol","Mounted":true,"Mountpoint":%q}}`, mountpoint)
+	if err := os.WriteFile(filepath.Join(dir, "volumes.json"), []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memStore{data: make(map[string][]byte)}
+	d, err := NewPlexVolumeDriver(Config{Directory: dir}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown(context.Background())
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	// The old container still has it mounted
+	if _, ok := store.data["vol"]; ok {
+		t.Fatal("uploaded while still mounted")
+	}
+	v, err := d.volume("vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.currentState() != stateMounted {
+		t.Fatalf("volume is %s", v.currentState())
+	}
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.data["vol"]; !ok {
+		t.Fatal("not uploaded on the last unmount")
+	}
+}
+
+func TestRemoveForgetsSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.Open("file://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewPlexVolumeDriver(Config{Directory: dir}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown(context.Background())
+
+	if err := d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"mode": "chunked"}}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(res.Mountpoint, "level.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.volume("vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := d.snapshotPath(v)
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(snapshot); !os.IsNotExist(err) {
+		t.Fatalf("snapshot kept: %v", err)
+	}
+}
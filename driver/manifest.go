@@ -0,0 +1,272 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/plexyhost/volume-driver/pkg/compression"
+	"github.com/plexyhost/volume-driver/storage"
+)
+
+// manifestDir is where the manifests are kept, in the state directory.
+const manifestDir = "manifests"
+
+type fileState struct {
+	Size    int64
+	ModTime time.Time
+	Mode    fs.FileMode
+	// Hash is only set for volumes with the checksum option
+	Hash string `json:",omitempty"`
+}
+
+// manifest is the state of a volume's files, keyed by the slash separated
+// path relative to the mountpoint. It is used to tell whether a volume
+// changed since it was last synced.
+type manifest map[string]fileState
+
+func (m manifest) equal(o manifest) bool {
+	if len(m) != len(o) {
+		return false
+	}
+	for name, a := range m {
+		b, ok := o[name]
+		if !ok || !a.ModTime.Equal(b.ModTime) || a.Size != b.Size || a.Mode != b.Mode || a.Hash != b.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// buildManifest walks root the same way compression.Compress does.
+func buildManifest(root string, opts compression.CompressOptions, checksum bool) (manifest, error) {
+	m := make(manifest)
+	err := filepath.WalkDir(root, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == "." {
+			return nil
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+
+		if opts.Excluded(name, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		state := fileState{
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Mode:    fi.Mode(),
+		}
+		// Directory sizes and mtimes don't tell us anything useful
+		if fi.IsDir() {
+			state.Size, state.ModTime = 0, time.Time{}
+		}
+		if checksum && fi.Mode().IsRegular() {
+			state.Hash, err = hashFile(file)
+			if err != nil {
+				return err
+			}
+		}
+		m[name] = state
+		return nil
+	})
+	return m, err
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (d *PlexVolumeDriver) manifestPath(v *volumeInfo) string {
+	return d.statePath(manifestDir, v.Name+".json")
+}
+
+// lastManifest returns the manifest of the last sync of v, or nil if there
+// is none.
+func (d *PlexVolumeDriver) lastManifest(v *volumeInfo) manifest {
+	if v.synced != nil {
+		return v.synced
+	}
+
+	f, err := os.Open(d.manifestPath(v))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("Failed to open manifest", "name", v.Name, "error", err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	var m manifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		log.Warn("Failed to read manifest", "name", v.Name, "error", err)
+		return nil
+	}
+	v.synced = m
+	return m
+}
+
+// saveManifest records m as the state of the last sync of v.
+func (d *PlexVolumeDriver) saveManifest(v *volumeInfo, m manifest) error {
+	v.synced = m
+
+	path := d.manifestPath(v)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(m); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// removeManifest forgets the last sync of v, along with the snapshot cached
+// for chunked volumes, so a volume created again under the same name starts
+// over.
+func (d *PlexVolumeDriver) removeManifest(v *volumeInfo) {
+	v.synced = nil
+	for _, path := range []string{d.manifestPath(v), d.snapshotPath(v)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Warn("Failed to remove manifest", "name", v.Name, "path", path, "error", err)
+		}
+	}
+}
+
+// currentManifest builds the manifest of the local data of v. Errors are
+// logged and result in a nil manifest, which never equals anything.
+func (d *PlexVolumeDriver) currentManifest(v *volumeInfo) manifest {
+	m, err := buildManifest(v.Mountpoint, d.compressOptionsFor(v), v.Options.Checksum)
+	if err != nil {
+		log.Warn("Failed to build manifest", "name", v.Name, "error", err)
+		return nil
+	}
+	return m
+}
+
+// errUnchanged means a volume wasn't uploaded, as it didn't change since its
+// last sync.
+var errUnchanged = errors.New("unchanged since last sync")
+
+// saveIfChanged uploads v with a sync slot of priority, unless nothing
+// changed since the last sync. With quiesce, the game server is quiesced once
+// the slot is acquired and resumed after the upload, and the volume is only
+// compared after the flush, so changes the server held in memory count. The
+// caller must hold v.opMu.
+func (d *PlexVolumeDriver) saveIfChanged(ctx context.Context, v *volumeInfo, priority int, quiesce bool) error {
+	var current manifest
+	// A degraded volume is uploaded even if unchanged, to confirm the remote
+	// matches it again
+	unchanged := func() bool {
+		current = d.currentManifest(v)
+		return current != nil && current.equal(d.lastManifest(v)) && !v.isDegraded()
+	}
+	// Without a flush to wait for, the slot is only taken for changes
+	if !quiesce && unchanged() {
+		d.skipUnchanged(v, current)
+		return nil
+	}
+
+	err := d.withSlot(ctx, priority, func() error {
+		if quiesce {
+			resume, err := d.quiesce(ctx, v)
+			if err != nil {
+				return err
+			}
+			defer resume()
+			if unchanged() {
+				return errUnchanged
+			}
+		}
+
+		err := d.saveToStore(ctx, v)
+		if err == nil || !storage.Retryable(err) {
+			return err
+		}
+		// The backend is down, leave the upload to the queue. The manifest is
+		// still saved, so the volume isn't queued again until it changes.
+		if qerr := d.enqueue(v); qerr != nil {
+			log.Error("Failed to queue upload", "name", v.Name, "error", qerr)
+			return errors.Join(err, qerr)
+		}
+		return errQueued
+	})
+	switch {
+	case errors.Is(err, errUnchanged):
+		d.skipUnchanged(v, current)
+		return nil
+	case errors.Is(err, errQueued):
+	case err != nil:
+		return err
+	default:
+		d.supersede(v)
+		d.rememberVersion(ctx, v)
+		v.mu.Lock()
+		v.lastSync = time.Now()
+		if v.Degraded {
+			v.Degraded = false
+			log.Info("Synced degraded volume", "name", v.Name)
+		}
+		v.mu.Unlock()
+	}
+
+	if current == nil {
+		d.removeManifest(v)
+		return nil
+	}
+	if err := d.saveManifest(v, current); err != nil {
+		log.Warn("Failed to save manifest", "name", v.Name, "error", err)
+	}
+	return nil
+}
+
+// skipUnchanged records a sync of v that was skipped, as the volume still
+// matched current.
+func (d *PlexVolumeDriver) skipUnchanged(v *volumeInfo, current manifest) {
+	v.mu.Lock()
+	v.skippedSyncs++
+	skipped := v.skippedSyncs
+	v.mu.Unlock()
+	log.Info("No changes since last sync, skipping upload", "name", v.Name, "files", len(current), "skipped", skipped)
+}
@@ -0,0 +1,442 @@
+package driver
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/plexyhost/volume-driver/pkg/compression"
+	"github.com/plexyhost/volume-driver/pkg/ignore"
+	"github.com/plexyhost/volume-driver/storage"
+)
+
+const (
+	optServerID         = "server_id"
+	optSyncInterval     = "sync_interval"
+	optCompressionLevel = "compression_level"
+	optCodec            = "codec"
+	optWindowSize       = "window_size"
+	optConcurrency      = "encoder_concurrency"
+	optExclude          = "exclude"
+	optInclude          = "include"
+	optBackend          = "backend"
+	optChecksum         = "checksum"
+	optMode             = "mode"
+	optUIDMap           = "uid_map"
+	optGIDMap           = "gid_map"
+	optMaxRestoreBytes  = "max_restore_bytes"
+	optMaxRestoreFiles  = "max_restore_files"
+	optOfflineMount     = "offline_mount"
+	optSyncMode         = "sync_mode"
+	optSyncQuiet        = "sync_quiet"
+	optSyncMinInterval  = "sync_min_interval"
+	optSyncMaxInterval  = "sync_max_interval"
+	optSnapshot         = "snapshot"
+	optRCONHost         = "rcon_host"
+	optRCONPort         = "rcon_port"
+	optRCONPassword     = "rcon_password"
+	optRCONRequired     = "rcon_required"
+)
+
+const (
+	// modeArchive uploads the whole volume as a compressed tarball
+	modeArchive = "archive"
+	// modeChunked only uploads the chunks the store doesn't have yet
+	modeChunked = "chunked"
+)
+
+const (
+	// syncPeriodic syncs every sync_interval
+	syncPeriodic = "periodic"
+	// syncWatch syncs after changes, once the volume has been quiet for
+	// sync_quiet
+	syncWatch = "watch"
+)
+
+// Defaults of the watch sync mode.
+const (
+	defaultSyncQuiet       = 30 * time.Second
+	defaultSyncMinInterval = time.Minute
+	defaultSyncMaxInterval = 10 * time.Minute
+)
+
+const (
+	// offlineNever fails mounts when the volume can't be restored
+	offlineNever = "never"
+	// offlineIfSynced mounts the local data when the storage backend is
+	// unavailable, if it's at least as new as the last successful sync
+	offlineIfSynced = "if_synced"
+)
+
+func checkOfflinePolicy(policy string) error {
+	if policy != offlineNever && policy != offlineIfSynced {
+		return fmt.Errorf("must be %q or %q", offlineNever, offlineIfSynced)
+	}
+	return nil
+}
+
+// defaultRCONPort is the default rcon.port of Minecraft servers.
+const defaultRCONPort = 25575
+
+// minSyncInterval guards the storage server against volumes that would
+// otherwise upload in a tight loop.
+const minSyncInterval = 10 * time.Second
+
+var serverIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// volumeOptions are the options given by `docker volume create -o ...`.
+// Zero values mean "use the driver default".
+type volumeOptions struct {
+	SyncInterval     time.Duration `json:",omitempty"`
+	CompressionLevel int           `json:",omitempty"`
+	// Codec is the archive codec name, empty means zstd
+	Codec       string `json:",omitempty"`
+	WindowSize  int    `json:",omitempty"`
+	Concurrency int    `json:",omitempty"`
+	// Exclude and Include are gitignore style rules, see pkg/ignore
+	Exclude []string `json:",omitempty"`
+	Include []string `json:",omitempty"`
+	Backend string   `json:",omitempty"`
+	// Checksum makes change detection hash file contents, instead of only
+	// looking at sizes and modification times
+	Checksum bool `json:",omitempty"`
+	// Mode is modeArchive or modeChunked, empty means modeArchive
+	Mode string `json:",omitempty"`
+	// UIDMap and GIDMap remap file ownership on restore, for rootless
+	// containers
+	UIDMap []compression.IDMap `json:",omitempty"`
+	GIDMap []compression.IDMap `json:",omitempty"`
+	// MaxRestoreBytes and MaxRestoreFiles cap what a restore may extract
+	MaxRestoreBytes int64 `json:",omitempty"`
+	MaxRestoreFiles int   `json:",omitempty"`
+	// OfflineMount is offlineNever or offlineIfSynced, empty means the
+	// driver default
+	OfflineMount string `json:",omitempty"`
+	// SyncMode is syncPeriodic or syncWatch, empty means syncPeriodic
+	SyncMode string `json:",omitempty"`
+	// SyncQuiet, SyncMinInterval and SyncMaxInterval tune syncWatch: a sync
+	// starts once no change was seen for SyncQuiet, but never sooner than
+	// SyncMinInterval after the last sync and never later than
+	// SyncMaxInterval after the first unsynced change
+	SyncQuiet       time.Duration `json:",omitempty"`
+	SyncMinInterval time.Duration `json:",omitempty"`
+	SyncMaxInterval time.Duration `json:",omitempty"`
+	// Snapshot archives a staged copy of the volume instead of the live
+	// files, see compression.Stage
+	Snapshot bool `json:",omitempty"`
+	// RCONHost, RCONPort and RCONPassword reach the game server, to quiesce
+	// it before every sync. RCONRequired skips syncs when that fails.
+	RCONHost     string `json:",omitempty"`
+	RCONPort     int    `json:",omitempty"`
+	RCONPassword string `json:",omitempty"`
+	RCONRequired bool   `json:",omitempty"`
+}
+
+// parseVolumeOptions validates the raw create options. The server id is
+// returned separately, as it's stored directly on the volumeInfo.
+func parseVolumeOptions(name string, raw map[string]string) (string, volumeOptions, error) {
+	var opts volumeOptions
+	serverID := name
+
+	for key, val := range raw {
+		switch key {
+		case optServerID:
+			serverID = val
+
+		case optSyncInterval:
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			if d < minSyncInterval {
+				return "", opts, fmt.Errorf("invalid %s %q: must be at least %s", key, val, minSyncInterval)
+			}
+			opts.SyncInterval = d
+
+		case optCompressionLevel:
+			lvl, err := strconv.Atoi(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			// Checked against the codec below
+			opts.CompressionLevel = lvl
+
+		case optCodec:
+			codec, err := compression.ParseCodec(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			opts.Codec = codec.String()
+
+		case optWindowSize:
+			n, err := parseSize(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			if n < compression.MinWindowSize || n > compression.MaxWindowSize || n&(n-1) != 0 {
+				return "", opts, fmt.Errorf("invalid %s %q: must be a power of two between %d and %d", key, val, compression.MinWindowSize, compression.MaxWindowSize)
+			}
+			opts.WindowSize = int(n)
+
+		case optConcurrency:
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return "", opts, fmt.Errorf("invalid %s %q: must be a positive number", key, val)
+			}
+			opts.Concurrency = n
+
+		case optExclude, optInclude:
+			patterns, err := parsePatterns(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			if key == optExclude {
+				opts.Exclude = patterns
+			} else {
+				opts.Include = patterns
+			}
+
+		case optBackend:
+			if err := storage.Check(val); err != nil {
+				return "", opts, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			opts.Backend = val
+
+		case optChecksum, optSnapshot, optRCONRequired:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			switch key {
+			case optChecksum:
+				opts.Checksum = b
+			case optSnapshot:
+				opts.Snapshot = b
+			default:
+				opts.RCONRequired = b
+			}
+
+		case optRCONHost:
+			opts.RCONHost = val
+
+		case optRCONPort:
+			port, err := strconv.Atoi(val)
+			if err != nil || port <= 0 || port > 65535 {
+				return "", opts, fmt.Errorf("invalid %s %q: must be a port number", key, val)
+			}
+			opts.RCONPort = port
+
+		case optRCONPassword:
+			opts.RCONPassword = val
+
+		case optMode:
+			if val != modeArchive && val != modeChunked {
+				return "", opts, fmt.Errorf("invalid %s %q: must be %q or %q", key, val, modeArchive, modeChunked)
+			}
+			opts.Mode = val
+
+		case optUIDMap, optGIDMap:
+			maps, err := parseIDMaps(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			if key == optUIDMap {
+				opts.UIDMap = maps
+			} else {
+				opts.GIDMap = maps
+			}
+
+		case optMaxRestoreBytes:
+			n, err := parseSize(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			opts.MaxRestoreBytes = n
+
+		case optMaxRestoreFiles:
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return "", opts, fmt.Errorf("invalid %s %q: must be a positive number", key, val)
+			}
+			opts.MaxRestoreFiles = n
+
+		case optSyncMode:
+			if val != syncPeriodic && val != syncWatch {
+				return "", opts, fmt.Errorf("invalid %s %q: must be %q or %q", key, val, syncPeriodic, syncWatch)
+			}
+			opts.SyncMode = val
+
+		case optSyncQuiet, optSyncMinInterval, optSyncMaxInterval:
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			if d <= 0 {
+				return "", opts, fmt.Errorf("invalid %s %q: must be positive", key, val)
+			}
+			switch key {
+			case optSyncQuiet:
+				opts.SyncQuiet = d
+			case optSyncMinInterval:
+				if d < minSyncInterval {
+					return "", opts, fmt.Errorf("invalid %s %q: must be at least %s", key, val, minSyncInterval)
+				}
+				opts.SyncMinInterval = d
+			default:
+				opts.SyncMaxInterval = d
+			}
+
+		case optOfflineMount:
+			if err := checkOfflinePolicy(val); err != nil {
+				return "", opts, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			opts.OfflineMount = val
+
+		default:
+			return "", opts, fmt.Errorf("unknown volume option %q", key)
+		}
+	}
+
+	codec := opts.codec()
+	if opts.CompressionLevel != 0 {
+		min, max := codec.Levels()
+		if min == max {
+			return "", opts, fmt.Errorf("invalid %s: codec %s has no levels", optCompressionLevel, codec)
+		}
+		if opts.CompressionLevel < min || opts.CompressionLevel > max {
+			return "", opts, fmt.Errorf("invalid %s %d: must be between %d and %d for codec %s", optCompressionLevel, opts.CompressionLevel, min, max, codec)
+		}
+	}
+	if opts.WindowSize != 0 && codec != compression.CodecZstd {
+		return "", opts, fmt.Errorf("invalid %s: only supported by codec %s", optWindowSize, compression.CodecZstd)
+	}
+
+	if opts.SyncMode == syncWatch {
+		if opts.SyncInterval != 0 {
+			return "", opts, fmt.Errorf("invalid %s: not used with %s %s, see %s and %s", optSyncInterval, optSyncMode, syncWatch, optSyncMinInterval, optSyncMaxInterval)
+		}
+		opts.SyncQuiet = cmp.Or(opts.SyncQuiet, defaultSyncQuiet)
+		opts.SyncMinInterval = cmp.Or(opts.SyncMinInterval, defaultSyncMinInterval)
+		opts.SyncMaxInterval = cmp.Or(opts.SyncMaxInterval, max(defaultSyncMaxInterval, opts.SyncMinInterval))
+		if opts.SyncMaxInterval < opts.SyncMinInterval {
+			return "", opts, fmt.Errorf("invalid %s %s: must be at least %s %s", optSyncMaxInterval, opts.SyncMaxInterval, optSyncMinInterval, opts.SyncMinInterval)
+		}
+	} else if opts.SyncQuiet != 0 || opts.SyncMinInterval != 0 || opts.SyncMaxInterval != 0 {
+		return "", opts, fmt.Errorf("invalid %s, %s and %s: only used with %s %s", optSyncQuiet, optSyncMinInterval, optSyncMaxInterval, optSyncMode, syncWatch)
+	}
+
+	if opts.RCONHost == "" {
+		if opts.RCONPort != 0 || opts.RCONPassword != "" || opts.RCONRequired {
+			return "", opts, fmt.Errorf("invalid %s, %s and %s: only used with %s", optRCONPort, optRCONPassword, optRCONRequired, optRCONHost)
+		}
+	} else {
+		if opts.RCONPassword == "" {
+			return "", opts, fmt.Errorf("missing %s: needed with %s", optRCONPassword, optRCONHost)
+		}
+		opts.RCONPort = cmp.Or(opts.RCONPort, defaultRCONPort)
+	}
+
+	if !serverIDPattern.MatchString(serverID) {
+		return "", opts, fmt.Errorf("invalid %s %q: only letters, digits, '.', '_' and '-' are allowed", optServerID, serverID)
+	}
+
+	return serverID, opts, nil
+}
+
+// redactOptions returns raw create options that are safe to log.
+func redactOptions(raw map[string]string) map[string]string {
+	if _, ok := raw[optRCONPassword]; !ok {
+		return raw
+	}
+	redacted := maps.Clone(raw)
+	redacted[optRCONPassword] = "<redacted>"
+	return redacted
+}
+
+// codec returns the archive codec of the volume. The name was validated in
+// parseVolumeOptions.
+func (o volumeOptions) codec() compression.Codec {
+	if o.Codec == "" {
+		return compression.CodecZstd
+	}
+	c, _ := compression.ParseCodec(o.Codec)
+	return c
+}
+
+// parseIDMaps parses comma separated container:host:size ranges, the same
+// format as /proc/self/uid_map.
+func parseIDMaps(val string) ([]compression.IDMap, error) {
+	var maps []compression.IDMap
+	for _, r := range strings.Split(val, ",") {
+		parts := strings.Split(strings.TrimSpace(r), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("range %q must be container:host:size", r)
+		}
+
+		var ids [3]int
+		for i, p := range parts {
+			id, err := strconv.Atoi(p)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("range %q must only contain non-negative numbers", r)
+			}
+			ids[i] = id
+		}
+		if ids[2] == 0 {
+			return nil, fmt.Errorf("range %q is empty", r)
+		}
+		maps = append(maps, compression.IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+	return maps, nil
+}
+
+// parseSize parses a byte count with an optional K, M, G or T suffix, in
+// powers of 1024.
+func parseSize(val string) (int64, error) {
+	mult := int64(1)
+	num := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(val), "B"))
+	if len(num) > 0 {
+		switch num[len(num)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("must be a positive size like 512M or 20G")
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size is too large")
+	}
+	return n * mult, nil
+}
+
+// parsePatterns splits comma separated ignore patterns and validates them.
+func parsePatterns(val string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(val, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := ignore.New(p); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,385 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/plexyhost/volume-driver/pkg/compression"
+	"github.com/plexyhost/volume-driver/storage"
+)
+
+// queueDir is where uploads that failed because the storage backend was
+// unavailable are spooled until it's back, in the state directory.
+const queueDir = "queue"
+
+// The queue is drained right away when something is queued, and retried with
+// a growing delay while the backend stays unavailable.
+const (
+	queueMinDelay = 10 * time.Second
+	queueMaxDelay = 5 * time.Minute
+)
+
+// errQueued means an upload failed, but was queued.
+var errQueued = errors.New("upload queued")
+
+// pendingUpload is the metadata of a queued upload. A volume has at most one,
+// queuing a newer upload replaces it.
+type pendingUpload struct {
+	Volume   string
+	ServerID string
+	// Backend is the backend option of the volume, empty for the default
+	Backend string `json:",omitempty"`
+	Mode    string
+	// Created is when the local data was archived
+	Created time.Time
+	// Attempts counts the failed uploads of the queued archive
+	Attempts int
+}
+
+// Queued archives are stored as <volume>.archive, their metadata as
+// <volume>.json. The metadata is written last, so an entry only exists once
+// its archive is complete. Chunked volumes are queued without an archive and
+// chunked again from the local data when drained, as unchanged chunks aren't
+// uploaded twice anyway.
+func (d *PlexVolumeDriver) queuePath(name, ext string) string {
+	return d.statePath(queueDir, name+ext)
+}
+
+// enqueue spools the local data of v for upload by the queue, replacing any
+// upload of v that is already queued. The caller must hold v.opMu.
+func (d *PlexVolumeDriver) enqueue(v *volumeInfo) error {
+	if err := os.MkdirAll(d.statePath(queueDir), 0755); err != nil {
+		return err
+	}
+
+	p := pendingUpload{
+		Volume:   v.Name,
+		ServerID: v.ServerID,
+		Backend:  v.Options.Backend,
+		Mode:     v.Options.Mode,
+		Created:  time.Now(),
+	}
+	if p.Mode != modeChunked {
+		if err := d.spoolArchive(v); err != nil {
+			return err
+		}
+	}
+	if err := d.writePending(p); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.pending = p.Created
+	v.mu.Unlock()
+
+	log.Warn("Storage unavailable, queued upload", "name", v.Name, "id", v.ServerID)
+	select {
+	case d.queueWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (d *PlexVolumeDriver) spoolArchive(v *volumeInfo) error {
+	opts := d.compressOptionsFor(v)
+	src, _, done, err := d.archiveSource(v, opts)
+	if err != nil {
+		return fmt.Errorf("spool archive: %w", err)
+	}
+	defer done()
+
+	path := d.queuePath(v.Name, ".archive")
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+
+	bw := bufio.NewWriterSize(f, pipeBufferSize)
+	stats, err := compression.Compress(src, bw, opts)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("spool archive: %w", err)
+	}
+	log.Debug("Spooled archive", "name", v.Name, "files", stats.Files, "bytes", stats.Bytes)
+	return os.Rename(path+".tmp", path)
+}
+
+func (d *PlexVolumeDriver) writePending(p pendingUpload) error {
+	path := d.queuePath(p.Volume, ".json")
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readPending returns the queued upload of the volume with name, or
+// os.ErrNotExist if there is none.
+func (d *PlexVolumeDriver) readPending(name string) (pendingUpload, error) {
+	var p pendingUpload
+	data, err := os.ReadFile(d.queuePath(name, ".json"))
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("queued upload %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// dropPending removes the queued upload of the volume with name, if any.
+func (d *PlexVolumeDriver) dropPending(name string) {
+	// Metadata first, so a crash in between never leaves an entry without
+	// its archive
+	for _, ext := range []string{".json", ".archive"} {
+		if err := os.Remove(d.queuePath(name, ext)); err != nil && !os.IsNotExist(err) {
+			log.Warn("Failed to remove queued upload", "name", name, "error", err)
+		}
+	}
+}
+
+// supersede drops the queued upload of v after newer data was uploaded, so
+// the queue can't overwrite it with older data. The caller must hold v.opMu.
+func (d *PlexVolumeDriver) supersede(v *volumeInfo) {
+	v.mu.Lock()
+	pending := !v.pending.IsZero()
+	v.pending = time.Time{}
+	v.mu.Unlock()
+	if pending {
+		log.Info("Dropped queued upload, newer data was uploaded", "name", v.Name)
+		d.dropPending(v.Name)
+	}
+}
+
+// pendingNames lists the volumes with a queued upload.
+func (d *PlexVolumeDriver) pendingNames() ([]string, error) {
+	entries, err := os.ReadDir(d.statePath(queueDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// loadQueue marks the volumes that have an upload queued from before the
+// driver was restarted, and removes leftovers of spools that were
+// interrupted. It must run before the queue is drained, as spools in
+// progress look the same.
+func (d *PlexVolumeDriver) loadQueue() {
+	tmps, _ := filepath.Glob(d.statePath(queueDir, "*.tmp"))
+	for _, tmp := range tmps {
+		_ = os.Remove(tmp)
+	}
+
+	names, err := d.pendingNames()
+	if err != nil {
+		log.Error("Failed to read upload queue", "error", err)
+		return
+	}
+	for _, name := range names {
+		p, err := d.readPending(name)
+		if err != nil {
+			log.Error("Dropping unreadable queued upload", "name", name, "error", err)
+			d.dropPending(name)
+			continue
+		}
+		if v, err := d.volume(name); err == nil {
+			v.mu.Lock()
+			v.pending = p.Created
+			v.mu.Unlock()
+		}
+	}
+	if len(names) > 0 {
+		log.Info("Replaying queued uploads", "count", len(names))
+	}
+}
+
+// drainQueue uploads the queued archives until ctx is done.
+func (d *PlexVolumeDriver) drainQueue(ctx context.Context) {
+	delay := queueMinDelay
+	for {
+		remaining, failed := d.drainOnce(ctx)
+		wait := delay
+		if failed {
+			delay = min(delay*2, queueMaxDelay)
+		} else {
+			wait, delay = queueMinDelay, queueMinDelay
+		}
+
+		// Nothing left, sleep until something is queued
+		if remaining == 0 {
+			select {
+			case <-d.queueWake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-d.queueWake:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		t.Stop()
+	}
+}
+
+// drainOnce tries every queued upload once. It returns how many are left and
+// whether any failed.
+func (d *PlexVolumeDriver) drainOnce(ctx context.Context) (remaining int, failed bool) {
+	names, err := d.pendingNames()
+	if err != nil {
+		log.Error("Failed to read upload queue", "error", err)
+		return 0, true
+	}
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return len(names), false
+		}
+		if err := d.uploadQueued(ctx, name); err != nil {
+			log.Warn("Queued upload failed", "name", name, "error", err)
+			remaining++
+			failed = true
+		}
+	}
+	return remaining, failed
+}
+
+// uploadQueued uploads the queued archive of the volume with name.
+func (d *PlexVolumeDriver) uploadQueued(ctx context.Context, name string) error {
+	v, err := d.volume(name)
+	if err != nil {
+		// The volume was removed, its last data still belongs in the store
+		return d.uploadPending(ctx, nil, name, priorityPeriodic)
+	}
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+	return d.uploadPending(ctx, v, name, priorityPeriodic)
+}
+
+// uploadPending uploads the queued archive of the volume with name with a
+// sync slot of priority, if it's still queued. v is nil if the volume was
+// removed, the caller must hold v.opMu otherwise.
+func (d *PlexVolumeDriver) uploadPending(ctx context.Context, v *volumeInfo, name string, priority int) error {
+	// Read under the lock, it may have been superseded while we waited
+	p, err := d.readPending(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Error("Dropping unreadable queued upload", "name", name, "error", err)
+		d.dropPending(name)
+		return nil
+	}
+
+	err = d.withSlot(ctx, priority, func() error { return d.storePending(ctx, v, p) })
+	if err != nil {
+		// Stopped by Shutdown, the upload is replayed on the next start
+		if ctx.Err() != nil {
+			return err
+		}
+		if !storage.Retryable(err) {
+			log.Error("Dropping queued upload that can't succeed", "name", name, "id", p.ServerID, "error", err)
+			d.dropPending(name)
+			if v != nil {
+				// The local data is still not in the store. Forget the
+				// manifest saved when it was queued, so the next sync
+				// uploads it even if nothing changed.
+				v.mu.Lock()
+				v.pending = time.Time{}
+				v.mu.Unlock()
+				d.removeManifest(v)
+				v.setDegraded(true)
+			}
+			return nil
+		}
+		p.Attempts++
+		if werr := d.writePending(p); werr != nil {
+			log.Warn("Failed to update queued upload", "name", name, "error", werr)
+		}
+		return err
+	}
+
+	d.dropPending(name)
+	if v != nil {
+		d.rememberVersion(ctx, v)
+		v.mu.Lock()
+		v.pending = time.Time{}
+		v.lastSync = p.Created
+		v.mu.Unlock()
+	}
+	log.Info("Uploaded queued archive", "name", name, "id", p.ServerID, "queued", time.Since(p.Created).Round(time.Second), "attempts", p.Attempts+1)
+	return nil
+}
+
+func (d *PlexVolumeDriver) storePending(ctx context.Context, v *volumeInfo, p pendingUpload) error {
+	if p.Mode == modeChunked {
+		if v == nil {
+			return fmt.Errorf("chunked volume %s was removed before its upload", p.Volume)
+		}
+		return d.saveChunked(ctx, v)
+	}
+
+	var store storage.Provider
+	var err error
+	switch {
+	case v != nil:
+		store, err = d.storeFor(v)
+	case p.Backend != "":
+		store, err = d.Config().OpenStore(p.Backend)
+	default:
+		d.mutex.RLock()
+		store = d.store
+		d.mutex.RUnlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(d.queuePath(p.Volume, ".archive"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// A file can be rewound, so the upload is retried as a whole
+	return store.Store(ctx, p.ServerID, f)
+}
+
+// hasPending reports whether v has an upload queued.
+func (v *volumeInfo) hasPending() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return !v.pending.IsZero()
+}
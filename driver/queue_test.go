@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/plexyhost/volume-driver/storage"
+)
+
+// memStore keeps archives in memory, and fails stores with storeErr while
+// it's set.
+type memStore struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	storeErr error
+}
+
+func (m *memStore) setStoreErr(err error) {
+	m.mu.Lock()
+	m.storeErr = err
+	m.mu.Unlock()
+}
+
+func (m *memStore) Store(ctx context.Context, id string, src io.Reader) error {
+	b, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.storeErr != nil {
+		return m.storeErr
+	}
+	m.data[id] = b
+	return nil
+}
+
+func (m *memStore) Retrieve(ctx context.Context, id string, dst io.Writer) error {
+	m.mu.Lock()
+	b, ok := m.data[id]
+	m.mu.Unlock()
+	if !ok {
+		return &storage.Error{Op: "retrieve", ID: id, Kind: storage.ErrNotFound}
+	}
+	_, err := dst.Write(b)
+	return err
+}
+
+func (m *memStore) Stat(ctx context.Context, id string) (storage.Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.data[id]
+	if !ok {
+		return storage.Object{}, &storage.Error{Op: "stat", ID: id, Kind: storage.ErrNotFound}
+	}
+	return storage.Object{ID: id, Size: int64(len(b))}, nil
+}
+
+func (m *memStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, id)
+	return nil
+}
+
+func (m *memStore) List(ctx context.Context) ([]storage.Object, error) {
+	return nil, nil
+}
+
+func TestQueuedUploadRejected(t *testing.T) {
+	dir := t.TempDir()
+	store := &memStore{data: make(map[string][]byte)}
+	d, err := NewPlexVolumeDriver(Config{Directory: dir}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown(context.Background())
+
+	if err := d.Create(&volume.CreateRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(res.Mountpoint, "level.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued while the backend is down
+	store.setStoreErr(&storage.Error{Op: "store", ID: "vol", Kind: storage.ErrUnavailable})
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.volume("vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.hasPending() {
+		t.Fatal("upload not queued")
+	}
+
+	// The queued upload is refused for good on the next mount
+	store.setStoreErr(&storage.Error{Op: "store", ID: "vol", Kind: storage.ErrUnauthorized})
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if v.hasPending() {
+		t.Fatal("rejected upload still pending")
+	}
+	if !v.isDegraded() {
+		t.Fatal("volume not degraded")
+	}
+	if _, err := os.Stat(d.manifestPath(v)); !os.IsNotExist(err) {
+		t.Fatalf("manifest of the queued upload kept: %v", err)
+	}
+
+	// Unchanged, but uploaded once the backend accepts it again
+	store.setStoreErr(nil)
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.data["vol"]; !ok {
+		t.Fatal("volume not uploaded")
+	}
+	if v.isDegraded() {
+		t.Fatal("volume still degraded")
+	}
+}
@@ -0,0 +1,83 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/plexyhost/volume-driver/pkg/rcon"
+)
+
+// quiesceTimeout bounds each RCON connection. save-all flush can take a while
+// on large worlds.
+const quiesceTimeout = 2 * time.Minute
+
+// quiesce turns saving off on the game server of v and flushes the world to
+// disk over RCON, so the volume holds a complete save that doesn't change
+// while it's archived. The returned function turns saving back on, and must
+// be called once the sync is done, whether it succeeded or not.
+//
+// Failures are logged and the volume is synced as is, unless it has the
+// rcon_required option, in which case the error is returned and the sync
+// skipped.
+func (d *PlexVolumeDriver) quiesce(ctx context.Context, v *volumeInfo) (func(), error) {
+	if v.Options.RCONHost == "" {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	d.sched.setQuiesced(v.Name, true)
+	sent, err := d.rcon(ctx, v, "save-off", "save-all flush")
+
+	resume := func() {
+		d.sched.setQuiesced(v.Name, false)
+		// Nothing to undo if save-off never reached the server
+		if sent == 0 {
+			return
+		}
+		// Even if ctx is done, the server must not be left without saving
+		if _, err := d.rcon(context.Background(), v, "save-on"); err != nil {
+			log.Error("Failed to turn saving back on", "name", v.Name, "error", err)
+			return
+		}
+		log.Debug("Resumed saving", "name", v.Name, "quiesced", time.Since(start))
+	}
+
+	if err != nil {
+		if v.Options.RCONRequired {
+			log.Error("Failed to quiesce game server, skipping sync", "name", v.Name, "error", err)
+			resume()
+			return nil, fmt.Errorf("quiesce %s: %w", v.Name, err)
+		}
+		log.Warn("Failed to quiesce game server, syncing anyway", "name", v.Name, "error", err)
+		return resume, nil
+	}
+	log.Debug("Quiesced game server", "name", v.Name, "took", time.Since(start))
+	return resume, nil
+}
+
+// rcon runs cmds on the game server of v, and returns how many were sent.
+func (d *PlexVolumeDriver) rcon(ctx context.Context, v *volumeInfo, cmds ...string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, quiesceTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(v.Options.RCONHost, strconv.Itoa(v.Options.RCONPort))
+	c, err := rcon.Dial(ctx, addr, v.Options.RCONPassword)
+	if err != nil {
+		return 0, fmt.Errorf("rcon %s: %w", addr, err)
+	}
+	defer c.Close()
+
+	for i, cmd := range cmds {
+		resp, err := c.Command(ctx, cmd)
+		if err != nil {
+			// It may have been run anyway
+			return i + 1, fmt.Errorf("rcon %s: %s: %w", addr, cmd, err)
+		}
+		log.Debug("Ran RCON command", "name", v.Name, "command", cmd, "response", resp)
+	}
+	return len(cmds), nil
+}
@@ -0,0 +1,98 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+	"github.com/plexyhost/volume-driver/storage"
+)
+
+// Config returns the config the driver currently runs with.
+func (d *PlexVolumeDriver) Config() Config {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.cfg
+}
+
+// reloadedChan returns the channel that is closed on the next reload.
+func (d *PlexVolumeDriver) reloadedChan() <-chan struct{} {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.reloaded
+}
+
+// Reload applies the settings of cfg that can change while volumes are
+// mounted: the sync period and concurrency, the storage endpoint and
+// retries, the ignore rules, the offline mount policy, the shutdown timeout
+// and the log level. Syncs that are already running finish with the old
+// settings.
+//
+// Settings that need a restart are left as they are, and are reported in the
+// returned error along with anything invalid. The other settings are still
+// applied in that case.
+func (d *PlexVolumeDriver) Reload(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config, nothing was applied: %w", err)
+	}
+
+	d.mutex.RLock()
+	old := d.cfg
+	d.mutex.RUnlock()
+
+	var errs []error
+	restart := func(setting string, from, to any) {
+		log.Warn("Setting needs a restart, keeping the old value", "setting", setting, "current", from, "new", to)
+		errs = append(errs, fmt.Errorf("%s can't change without a restart", setting))
+	}
+	if cfg.Directory != old.Directory {
+		restart("directory", old.Directory, cfg.Directory)
+		cfg.Directory = old.Directory
+	}
+	if cfg.StateFile != old.StateFile {
+		restart("state_file", old.StateFile, cfg.StateFile)
+		cfg.StateFile = old.StateFile
+	}
+	if cfg.Socket != old.Socket {
+		restart("socket", old.Socket, cfg.Socket)
+		cfg.Socket = old.Socket
+	}
+	if cfg.MetricsAddr != old.MetricsAddr {
+		restart("metrics_addr", old.MetricsAddr, cfg.MetricsAddr)
+		cfg.MetricsAddr = old.MetricsAddr
+	}
+
+	// Open the new provider first, so a failure leaves the old one in place
+	var store storage.Provider
+	if cfg.Endpoint != old.Endpoint || cfg.retryOptions() != old.retryOptions() {
+		var err error
+		store, err = cfg.OpenStore(cfg.Endpoint)
+		if err != nil {
+			log.Error("Keeping the old storage endpoint", "error", err)
+			errs = append(errs, err)
+			cfg.Endpoint = old.Endpoint
+			cfg.RetryAttempts, cfg.RetryDelay, cfg.RetryMaxDelay, cfg.AttemptTimeout =
+				old.RetryAttempts, old.RetryDelay, old.RetryMaxDelay, old.AttemptTimeout
+		}
+	}
+
+	// Validated above
+	rules, _ := cfg.rules()
+
+	d.mutex.Lock()
+	d.cfg = cfg
+	d.syncPeriod = cfg.SyncPeriod
+	d.ignore = rules
+	if store != nil {
+		d.store = store
+	}
+	close(d.reloaded)
+	d.reloaded = make(chan struct{})
+	d.mutex.Unlock()
+
+	d.slots.setLimit(cfg.MaxConcurrentSyncs)
+
+	log.SetLevel(cfg.Level())
+	log.Info("Reloaded config", cfg.Fields()...)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,373 @@
+package driver
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Sync priorities, lower ones get a sync slot first.
+const (
+	// priorityFlush is for uploads someone waits on: unmounts, shutdown and
+	// mounts of volumes with a queued upload
+	priorityFlush = iota
+	// priorityPeriodic is for periodic saves and the upload queue
+	priorityPeriodic
+)
+
+// syncJitter is how far each periodic sync is moved at random, as a fraction
+// of the sync period, so volumes don't line up again over time.
+const syncJitter = 0.1
+
+// slots caps how many compressions and uploads run at once. Waiters are
+// served by priority, then in the order they arrived.
+type slots struct {
+	mu      sync.Mutex
+	limit   int
+	used    int
+	waiters []*slotWaiter
+}
+
+type slotWaiter struct {
+	priority int
+	ready    chan struct{}
+}
+
+func newSlots(limit int) *slots {
+	return &slots{limit: max(limit, 1)}
+}
+
+// acquire waits for a free slot. The slot must be given back with release,
+// unless an error is returned.
+func (s *slots) acquire(ctx context.Context, priority int) error {
+	s.mu.Lock()
+	if s.used < s.limit {
+		s.used++
+		s.mu.Unlock()
+		return nil
+	}
+	w := &slotWaiter{priority: priority, ready: make(chan struct{})}
+	// Behind everyone with the same or a lower priority
+	i := slices.IndexFunc(s.waiters, func(o *slotWaiter) bool { return o.priority > priority })
+	if i < 0 {
+		i = len(s.waiters)
+	}
+	s.waiters = slices.Insert(s.waiters, i, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if i := slices.Index(s.waiters, w); i >= 0 {
+			s.waiters = slices.Delete(s.waiters, i, i+1)
+		} else {
+			// Granted while giving up, pass it on
+			s.used--
+			s.grant()
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *slots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used--
+	s.grant()
+}
+
+// setLimit changes the number of slots. Syncs that are already running
+// finish when the limit is lowered.
+func (s *slots) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = max(limit, 1)
+	s.grant()
+}
+
+// grant hands free slots to the waiters. The caller must hold s.mu.
+func (s *slots) grant() {
+	for s.used < s.limit && len(s.waiters) > 0 {
+		w := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		s.used++
+		close(w.ready)
+	}
+}
+
+// withSlot runs fn with a sync slot.
+func (d *PlexVolumeDriver) withSlot(ctx context.Context, priority int, fn func() error) error {
+	if err := d.slots.acquire(ctx, priority); err != nil {
+		return err
+	}
+	defer d.slots.release()
+	return fn()
+}
+
+// scheduled is a mounted volume waiting for its next periodic sync.
+type scheduled struct {
+	// ctx is the context of the mount, the volume is dropped once it's done
+	ctx    context.Context
+	period time.Duration
+	// next is when the next sync is due, zero while a watched volume has
+	// no changes
+	next    time.Time
+	running bool
+
+	// watch is set for volumes in the watch sync mode, see touch
+	watch                 bool
+	quiet, minGap, maxGap time.Duration
+	// dirtySince is when the first change since the last sync was seen,
+	// lastChange when the latest was
+	dirtySince, lastChange time.Time
+	// syncing is the dirtySince of the changes the running sync picks up,
+	// they are still unsynced if it fails
+	syncing time.Time
+	// lastRun is when the last sync started
+	lastRun time.Time
+	// quiesced is set while the game server is flushed and not saving for a
+	// sync. The changes seen then are from the flush, and end up in that
+	// sync.
+	quiesced bool
+}
+
+// watchDue is when a watched volume with changes is due. The caller must
+// hold the scheduler lock.
+func (e *scheduled) watchDue() time.Time {
+	due := e.lastChange.Add(e.quiet)
+	if limit := e.dirtySince.Add(e.maxGap); limit.Before(due) {
+		due = limit
+	}
+	if earliest := e.lastRun.Add(e.minGap); due.Before(earliest) {
+		due = earliest
+	}
+	return due
+}
+
+// scheduler runs the periodic syncs of all mounted volumes from one
+// goroutine, spread over their sync period instead of all at once.
+type scheduler struct {
+	mu      sync.Mutex
+	volumes map[string]*scheduled
+	wake    chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		volumes: make(map[string]*scheduled),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (s *scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// spread picks a random moment in the first period, so volumes mounted
+// together, e.g. after a reboot, don't sync together.
+func spread(period time.Duration) time.Duration {
+	return rand.N(period) + 1
+}
+
+// jitter moves period by up to syncJitter either way.
+func jitter(period time.Duration) time.Duration {
+	j := time.Duration(float64(period) * syncJitter)
+	if j <= 0 {
+		return period
+	}
+	return period - j + rand.N(2*j+1)
+}
+
+// schedule starts the periodic syncs of v, replacing any earlier schedule.
+// Volumes in the watch sync mode are synced after changes instead, unless
+// they can't be watched.
+func (d *PlexVolumeDriver) schedule(v *volumeInfo) {
+	v.mu.Lock()
+	ctx := v.ctx
+	v.mu.Unlock()
+
+	e := &scheduled{ctx: ctx, lastRun: time.Now()}
+	if v.Options.SyncMode == syncWatch {
+		e.watch = true
+		e.quiet, e.minGap, e.maxGap = v.Options.SyncQuiet, v.Options.SyncMinInterval, v.Options.SyncMaxInterval
+		if err := d.watch(ctx, v, e); err != nil {
+			log.Warn("Failed to watch volume, syncing periodically", "volume", v.Name, "error", err)
+			e.watch = false
+		}
+	}
+	if !e.watch {
+		e.period = d.syncPeriodFor(v)
+		e.next = time.Now().Add(spread(e.period))
+	}
+
+	d.sched.mu.Lock()
+	d.sched.volumes[v.Name] = e
+	d.sched.mu.Unlock()
+	d.sched.poke()
+	if e.watch {
+		log.Debug("Watching volume for changes", "volume", v.Name, "quiet", e.quiet, "min", e.minGap, "max", e.maxGap)
+	} else {
+		log.Debug("Scheduled periodic save", "volume", v.Name, "period", e.period, "first", e.next.Format(time.RFC3339))
+	}
+}
+
+// touch records a change in the watched volume of e.
+func (s *scheduler) touch(e *scheduled) {
+	now := time.Now()
+	s.mu.Lock()
+	if e.quiesced {
+		s.mu.Unlock()
+		return
+	}
+	if e.dirtySince.IsZero() {
+		e.dirtySince = now
+	}
+	e.lastChange = now
+	e.next = e.watchDue()
+	s.mu.Unlock()
+	s.poke()
+}
+
+// setQuiesced marks whether the game server of the volume with name is
+// quiesced, see scheduled.quiesced.
+func (s *scheduler) setQuiesced(name string, quiesced bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.volumes[name]; ok {
+		e.quiesced = quiesced
+	}
+}
+
+// runScheduler starts the periodic syncs that are due until ctx is done.
+func (d *PlexVolumeDriver) runScheduler(ctx context.Context) {
+	s := d.sched
+	for {
+		now := time.Now()
+		wait := time.Duration(-1)
+
+		s.mu.Lock()
+		for name, e := range s.volumes {
+			if e.ctx.Err() != nil {
+				log.Info("Volume context exceeded, stopping periodic save", "volume", name)
+				delete(s.volumes, name)
+				continue
+			}
+			if e.running || e.next.IsZero() {
+				continue
+			}
+			if until := e.next.Sub(now); until > 0 {
+				if wait < 0 || until < wait {
+					wait = until
+				}
+				continue
+			}
+			e.running = true
+			// Changes from now on need another sync
+			e.syncing, e.dirtySince, e.lastRun = e.dirtySince, time.Time{}, now
+			go d.periodicSync(name, e)
+		}
+		s.mu.Unlock()
+
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			fire = timer.C
+		}
+		select {
+		case <-fire:
+		case <-s.wake:
+		case <-d.reloadedChan():
+			d.reschedule()
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// periodicSync syncs the volume with name and schedules its next sync.
+func (d *PlexVolumeDriver) periodicSync(name string, e *scheduled) {
+	v, err := d.volume(name)
+	if err != nil {
+		return
+	}
+
+	log.Debug("Syncing volume", "id", v.ServerID)
+	failed := false
+	v.opMu.Lock()
+	// The volume may have been unmounted while waiting for the lock
+	if e.ctx.Err() == nil {
+		if err := d.sync(context.Background(), v, priorityPeriodic); err != nil {
+			log.Error("Failed to sync volume periodically", "id", v.ServerID, "error", err)
+			failed = true
+		}
+	}
+	v.opMu.Unlock()
+
+	period := d.syncPeriodFor(v)
+	d.sched.mu.Lock()
+	e.running = false
+	if failed && e.watch && !e.syncing.IsZero() {
+		// The changes are still unsynced, retry once the minimum interval
+		// has passed instead of waiting for the next change
+		if e.dirtySince.IsZero() || e.syncing.Before(e.dirtySince) {
+			e.dirtySince = e.syncing
+		}
+	}
+	e.syncing = time.Time{}
+	switch {
+	case !e.watch:
+		e.period = period
+		e.next = time.Now().Add(jitter(period))
+	case e.dirtySince.IsZero():
+		e.next = time.Time{}
+	default:
+		// Changed while syncing
+		e.next = e.watchDue()
+	}
+	d.sched.mu.Unlock()
+	d.sched.poke()
+}
+
+// reschedule picks up sync periods changed by Reload.
+func (d *PlexVolumeDriver) reschedule() {
+	d.sched.mu.Lock()
+	names := make([]string, 0, len(d.sched.volumes))
+	for name := range d.sched.volumes {
+		names = append(names, name)
+	}
+	d.sched.mu.Unlock()
+
+	for _, name := range names {
+		v, err := d.volume(name)
+		if err != nil {
+			continue
+		}
+		period := d.syncPeriodFor(v)
+
+		d.sched.mu.Lock()
+		if e, ok := d.sched.volumes[name]; ok && !e.watch && e.period != period {
+			log.Info("Rescheduling periodic save", "volume", name, "period", period)
+			e.period = period
+			if !e.running {
+				e.next = time.Now().Add(spread(period))
+			}
+		}
+		d.sched.mu.Unlock()
+	}
+}
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/plexyhost/volume-driver/pkg/compression"
+)
+
+// stagingDir is where volumes with the snapshot option are staged while
+// they're archived, in the state directory. It's on the same filesystem as
+// the mountpoints, so files can be reflinked.
+const stagingDir = "staging"
+
+// archiveSource returns the directory to archive v from, and a function to
+// call once it's archived. For volumes with the snapshot option that's a
+// staged copy of the mountpoint, so the archive is consistent while the
+// volume keeps changing. The stats are those of staging, the files it left
+// out aren't seen by whatever archives the copy. The caller must hold
+// v.opMu.
+func (d *PlexVolumeDriver) archiveSource(v *volumeInfo, opts compression.CompressOptions) (string, compression.Stats, func(), error) {
+	if !v.Options.Snapshot {
+		return v.Mountpoint, compression.Stats{}, func() {}, nil
+	}
+
+	dir := d.statePath(stagingDir, v.Name)
+	// Left over if the driver stopped while archiving
+	if err := os.RemoveAll(dir); err != nil {
+		return "", compression.Stats{}, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return "", compression.Stats{}, nil, err
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warn("Failed to remove staged copy", "name", v.Name, "error", err)
+		}
+	}
+
+	start := time.Now()
+	stats, err := compression.Stage(v.Mountpoint, dir, opts)
+	if err != nil {
+		cleanup()
+		return "", stats, nil, err
+	}
+	log.Debug("Staged volume", "name", v.Name, "files", stats.Files, "bytes", stats.Bytes, "cloned", stats.Cloned, "took", time.Since(start))
+	return dir, stats, cleanup, nil
+}
+
+// clearStaging removes the staged copies left over from a previous run.
+func (d *PlexVolumeDriver) clearStaging() {
+	if err := os.RemoveAll(d.statePath(stagingDir)); err != nil {
+		log.Warn("Failed to remove staged copies", "error", err)
+	}
+}
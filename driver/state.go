@@ -0,0 +1,82 @@
+package driver
+
+import "fmt"
+
+// volumeState is where a volume is in its lifecycle. Only the transitions in
+// validTransitions are allowed, anything else is rejected.
+type volumeState int
+
+const (
+	// stateCreated is a volume that exists locally but isn't mounted
+	stateCreated volumeState = iota
+	// stateRestoring is a volume being downloaded on its first mount
+	stateRestoring
+	// stateMounted is a volume in use by at least one container
+	stateMounted
+	// stateSyncing is a mounted volume being uploaded
+	stateSyncing
+	// stateUnmounting is a volume doing its final upload on the last unmount
+	stateUnmounting
+	// stateRemoving is a volume whose local data is being deleted
+	stateRemoving
+)
+
+var stateNames = map[volumeState]string{
+	stateCreated:    "created",
+	stateRestoring:  "restoring",
+	stateMounted:    "mounted",
+	stateSyncing:    "syncing",
+	stateUnmounting: "unmounting",
+	stateRemoving:   "removing",
+}
+
+func (s volumeState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+var validTransitions = map[volumeState][]volumeState{
+	stateCreated:    {stateRestoring, stateRemoving},
+	stateRestoring:  {stateMounted, stateCreated},
+	stateMounted:    {stateSyncing, stateUnmounting},
+	stateSyncing:    {stateMounted},
+	stateUnmounting: {stateCreated},
+	stateRemoving:   {stateCreated},
+}
+
+func canTransition(from, to volumeState) bool {
+	for _, s := range validTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves v to the given state, or returns an error if that isn't
+// allowed from the state it is in.
+func (v *volumeInfo) transition(to volumeState) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !canTransition(v.state, to) {
+		return fmt.Errorf("volume %s is %s, can't move to %s", v.Name, v.state, to)
+	}
+	v.state = to
+
+	switch to {
+	case stateMounted:
+		v.Mounted = true
+	case stateCreated:
+		v.Mounted = false
+	}
+	return nil
+}
+
+func (v *volumeInfo) currentState() volumeState {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.state
+}
@@ -0,0 +1,28 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// stateDir is where the driver keeps its own files, in Directory next to the
+// mountpoints. Volume names start with a letter or digit, so no volume can
+// take it.
+const stateDir = ".plexdriver"
+
+// statePath joins elem to the state directory.
+func (d *PlexVolumeDriver) statePath(elem ...string) string {
+	return filepath.Join(append([]string{d.endpoint, stateDir}, elem...)...)
+}
+
+// checkVolumeName rejects names that would put the mountpoint anywhere but
+// directly in Directory, or on top of the state file.
+func (d *PlexVolumeDriver) checkVolumeName(name string) error {
+	if !serverIDPattern.MatchString(name) {
+		return fmt.Errorf("invalid volume name %q: only letters, digits, '.', '_' and '-' are allowed, starting with a letter or digit", name)
+	}
+	if name == d.volumeInfoPath {
+		return fmt.Errorf("invalid volume name %q: used by the driver", name)
+	}
+	return nil
+}
@@ -1,53 +1,247 @@
 package driver
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"errors"
-	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/plexyhost/volume-driver/pkg/compression"
+	"github.com/plexyhost/volume-driver/pkg/ignore"
 	"github.com/plexyhost/volume-driver/storage"
 
 	"github.com/charmbracelet/log"
 )
 
-func (d *PlexVolumeDriver) saveToStore(vol *volumeInfo) error {
-	buf := bytes.NewBuffer(make([]byte, 0, 1024*1024)) // Pre-allocate 1MB
+// pipeBufferSize is how much of the archive stream is buffered between the
+// compressor and the storage provider.
+const pipeBufferSize = 1024 * 1024
+
+// restoreDir is where restores are extracted before they replace the
+// mountpoint, in the state directory.
+const restoreDir = "restore"
+
+// ignoreFile is an optional file at the root of a volume with extra ignore
+// rules, in the same format as a .gitignore.
+const ignoreFile = ".plexignore"
+
+// compressOptionsFor returns how vol is archived. The ignore rules are the
+// driver wide ones, then the ones from the volume options and last the ones
+// from the ignore file, so later rules take precedence.
+func (d *PlexVolumeDriver) compressOptionsFor(vol *volumeInfo) compression.CompressOptions {
+	rules := &ignore.Matcher{}
+	d.mutex.RLock()
+	rules.Merge(d.ignore)
+	d.mutex.RUnlock()
+	// Validated in parseVolumeOptions
+	_ = rules.Add(vol.Options.Exclude...)
+	_ = rules.Include(vol.Options.Include...)
+
+	if f, err := os.Open(filepath.Join(vol.Mountpoint, ignoreFile)); err == nil {
+		fileRules, err := ignore.Parse(f)
+		f.Close()
+		if err != nil {
+			log.Warn("Ignoring invalid ignore file", "name", vol.Name, "error", err)
+		} else {
+			rules.Merge(fileRules)
+		}
+	}
+
+	return compression.CompressOptions{
+		Codec:       vol.Options.codec(),
+		Level:       vol.Options.CompressionLevel,
+		WindowSize:  vol.Options.WindowSize,
+		Concurrency: vol.Options.Concurrency,
+		Ignore:      rules,
+	}
+}
+
+func (d *PlexVolumeDriver) saveToStore(ctx context.Context, vol *volumeInfo) error {
+	if vol.Options.Mode == modeChunked {
+		return d.saveChunked(ctx, vol)
+	}
+
+	store, err := d.storeFor(vol)
+	if err != nil {
+		return err
+	}
+	opts := d.compressOptionsFor(vol)
 	start := time.Now()
 
-	err := compression.Compress(vol.Mountpoint, buf)
+	src, staged, done, err := d.archiveSource(vol, opts)
 	if err != nil {
-		log.Errorf("Error while compressing %s: %s", vol.ServerID, err)
+		log.Errorf("Error while staging %s: %s", vol.ServerID, err)
 		return err
 	}
-	log.Infof("Compressed %s in %s", vol.ServerID, time.Since(start))
+	defer done()
 
-	start = time.Now()
-	err = d.store.Store(vol.ServerID, buf)
+	// Stream the archive straight into the provider.
+	// compress -> pipe -> store
+	pr, pw := io.Pipe()
+	compressErr := make(chan error, 1)
+	var compressStats compression.Stats
+	go func() {
+		bw := bufio.NewWriterSize(pw, pipeBufferSize)
+		stats, err := compression.Compress(src, bw, opts)
+		if err == nil {
+			err = bw.Flush()
+		}
+		stats.SkippedFiles += staged.SkippedFiles
+		stats.SkippedBytes += staged.SkippedBytes
+		// Closing with a nil error signals EOF to the provider
+		pw.CloseWithError(err)
+		compressStats = stats
+		compressErr <- err
+	}()
+
+	err = store.Store(ctx, vol.ServerID, pr)
+	// Unblock the compressor if the provider stopped reading early
+	pr.CloseWithError(errStoreAborted)
+	cerr := <-compressErr
+
+	if cerr != nil && !errors.Is(cerr, errStoreAborted) {
+		log.Errorf("Error while compressing %s: %s", vol.ServerID, cerr)
+		return cerr
+	}
 	if err != nil {
 		log.Errorf("Error while storing %s: %s", vol.ServerID, err)
 		return err
 	}
-	log.Infof("Stored %s in %s", vol.ServerID, time.Since(start))
+	log.Info("Compressed and stored volume", "id", vol.ServerID, "files", compressStats.Files, "bytes", compressStats.Bytes,
+		"skipped_files", compressStats.SkippedFiles, "skipped_bytes", compressStats.SkippedBytes, "took", time.Since(start))
 	return nil
 }
 
-func (d *PlexVolumeDriver) loadFromStore(vol *volumeInfo) error {
-	var buf bytes.Buffer
-
-	fmt.Println("loading from store")
+// sweepRestores cleans up after restores that were interrupted.
+func (d *PlexVolumeDriver) sweepRestores() {
+	if err := compression.Sweep(d.statePath(restoreDir), d.endpoint); err != nil {
+		log.Warn("Failed to clean up interrupted restores", "error", err)
+	}
+}
 
-	err := d.store.Retrieve(vol.ServerID, &buf)
-	fmt.Printf("err: %v\n", err)
-	if errors.Is(err, os.ErrNotExist) || errors.Is(err, storage.ErrCacheHit) {
-		return nil
+func (d *PlexVolumeDriver) loadFromStore(ctx context.Context, vol *volumeInfo) error {
+	if vol.Options.Mode == modeChunked {
+		return d.loadChunked(ctx, vol)
 	}
 
+	store, err := d.storeFor(vol)
 	if err != nil {
 		return err
 	}
+	known := d.knownVersion(vol)
+	start := time.Now()
+
+	// Stream the download straight into the decompressor.
+	// retrieve -> pipe -> decompress
+	pr, pw := io.Pipe()
+	retrieveErr := make(chan error, 1)
+	var version string
+	go func() {
+		var err error
+		version, err = storage.RetrieveIfChanged(ctx, store, vol.ServerID, known, pw)
+		pw.CloseWithError(err)
+		retrieveErr <- err
+	}()
 
-	return compression.Decompress(&buf, vol.Mountpoint)
+	// Don't touch the local data before we know the provider has something
+	// for us. Decompress replaces the mountpoint.
+	br := bufio.NewReaderSize(pr, pipeBufferSize)
+	if _, err := br.Peek(1); err != nil {
+		pr.CloseWithError(errStoreAborted)
+		err = <-retrieveErr
+		if errors.Is(err, storage.ErrNotModified) {
+			log.Info("Remote unchanged, keeping the local data", "id", vol.ServerID, "version", known)
+			d.markRestored(vol, known)
+			return nil
+		}
+		if err == nil || errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		log.Errorf("Error while retrieving %s: %s", vol.ServerID, err)
+		return err
+	}
+
+	derr := compression.Decompress(br, vol.Mountpoint, compression.DecompressOptions{
+		UIDMap:   vol.Options.UIDMap,
+		GIDMap:   vol.Options.GIDMap,
+		MaxBytes: vol.Options.MaxRestoreBytes,
+		MaxFiles: vol.Options.MaxRestoreFiles,
+		TempDir:  d.statePath(restoreDir),
+	})
+	pr.CloseWithError(errStoreAborted)
+	err = <-retrieveErr
+
+	if err != nil && !errors.Is(err, errStoreAborted) {
+		log.Errorf("Error while retrieving %s: %s", vol.ServerID, err)
+		return err
+	}
+	if derr != nil {
+		if errors.Is(derr, compression.ErrCorrupt) {
+			derr = corrupt(vol, derr)
+		}
+		log.Errorf("Error while decompressing %s: %s", vol.ServerID, derr)
+		return derr
+	}
+	log.Infof("Retrieved and decompressed %s in %s", vol.ServerID, time.Since(start))
+	d.markRestored(vol, version)
+	return nil
 }
+
+// knownVersion returns the version of the remote archive the local data of
+// vol matches, or "" if the local data changed since it was last synced.
+func (d *PlexVolumeDriver) knownVersion(vol *volumeInfo) string {
+	vol.mu.Lock()
+	version := vol.RemoteVersion
+	vol.mu.Unlock()
+	if version == "" {
+		return ""
+	}
+	last := d.lastManifest(vol)
+	if last == nil || !d.currentManifest(vol).equal(last) {
+		log.Debug("Local data changed since the last sync, restoring it", "name", vol.Name)
+		return ""
+	}
+	return version
+}
+
+// rememberVersion records the version of the archive of vol that was just
+// stored, so the next mount can skip the download while it's unchanged.
+func (d *PlexVolumeDriver) rememberVersion(ctx context.Context, vol *volumeInfo) {
+	var version string
+	if store, err := d.storeFor(vol); err == nil {
+		obj, err := store.Stat(ctx, vol.ServerID)
+		if err != nil {
+			log.Debug("Failed to get the version of the stored archive", "id", vol.ServerID, "error", err)
+		}
+		version = obj.Version
+	}
+	vol.mu.Lock()
+	vol.RemoteVersion = version
+	vol.mu.Unlock()
+}
+
+// corrupt marks err as a restore failure caused by damaged remote data.
+func corrupt(vol *volumeInfo, err error) error {
+	return &storage.Error{Op: "retrieve", ID: vol.ServerID, Kind: storage.ErrCorrupt, Err: err}
+}
+
+// markRestored records that the local data of vol now matches the remote
+// archive with version.
+func (d *PlexVolumeDriver) markRestored(vol *volumeInfo, version string) {
+	vol.mu.Lock()
+	vol.lastSync = time.Now()
+	vol.RemoteVersion = version
+	vol.mu.Unlock()
+	if m := d.currentManifest(vol); m != nil {
+		if err := d.saveManifest(vol, m); err != nil {
+			log.Warn("Failed to save manifest", "name", vol.Name, "error", err)
+		}
+	}
+}
+
+// errStoreAborted is used to close the pipe from the reading side, so the
+// writing side stops instead of blocking forever.
+var errStoreAborted = errors.New("stream aborted by the other side")
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/charmbracelet/log"
+	"github.com/fsnotify/fsnotify"
+	"github.com/plexyhost/volume-driver/pkg/compression"
+)
+
+// watch reports changes to the files of v to its schedule e until ctx is
+// done. inotify isn't recursive, so every directory is watched on its own,
+// and new ones are added as they appear. Changes to ignored files don't
+// count.
+func (d *PlexVolumeDriver) watch(ctx context.Context, v *volumeInfo, e *scheduled) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	opts := d.compressOptionsFor(v)
+	if err := watchTree(w, v.Mountpoint, v.Mountpoint, opts); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				name, isDir := relName(v.Mountpoint, ev.Name)
+				if name == "" || opts.Excluded(name, isDir) {
+					continue
+				}
+				if ev.Has(fsnotify.Create) && isDir {
+					if err := watchTree(w, v.Mountpoint, ev.Name, opts); err != nil {
+						log.Warn("Failed to watch new directory", "volume", v.Name, "dir", name, "error", err)
+					}
+				}
+				d.sched.touch(e)
+
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// Events were lost, so assume something changed
+				log.Warn("Watch error, syncing to be safe", "volume", v.Name, "error", err)
+				d.sched.touch(e)
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// watchTree adds dir and the directories below it to w, skipping ignored
+// ones.
+func watchTree(w *fsnotify.Watcher, root, dir string, opts compression.CompressOptions) error {
+	return filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed while walking, its parent reports that
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !e.IsDir() {
+			return nil
+		}
+		if name, _ := relName(root, path); name != "" && opts.Excluded(name, true) {
+			return filepath.SkipDir
+		}
+		return w.Add(path)
+	})
+}
+
+// relName returns the slash separated name of path relative to root, the
+// way ignore rules see it, and whether it's a directory. The name is empty
+// for root itself.
+func relName(root, path string) (string, bool) {
+	name, err := filepath.Rel(root, path)
+	if err != nil || name == "." {
+		return "", false
+	}
+	isDir := false
+	if fi, err := os.Lstat(path); err == nil {
+		isDir = fi.IsDir()
+	}
+	return filepath.ToSlash(name), isDir
+}
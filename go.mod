@@ -5,8 +5,12 @@ go 1.23
 require (
 	github.com/charmbracelet/log v0.4.0
 	github.com/docker/go-plugins-helpers v0.0.0-20240701071450-45e2431495c8
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/klauspost/compress v1.17.11
+	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/sys v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -23,5 +27,4 @@ require (
 	github.com/muesli/termenv v0.15.2 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
-	golang.org/x/sys v0.13.0 // indirect
 )
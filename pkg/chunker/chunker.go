@@ -0,0 +1,111 @@
+package chunker
+
+import (
+	"io"
+	"math/bits"
+)
+
+const (
+	// MinSize, AvgSize and MaxSize bound the size of the chunks. Cut points
+	// are content defined, so an insert or change in a file only changes the
+	// chunks around it.
+	MinSize = 64 * 1024
+	AvgSize = 256 * 1024
+	MaxSize = 1024 * 1024
+)
+
+var (
+	gear [256]uint64
+
+	// Normalized chunking: a harder mask before AvgSize and an easier one
+	// after, which keeps the chunk sizes close to AvgSize.
+	maskS = topBits(bits.Len(AvgSize) + 1)
+	maskL = topBits(bits.Len(AvgSize) - 3)
+)
+
+func init() {
+	// The gear table has to be the same forever, or no chunk will ever be
+	// deduplicated against an older snapshot again. splitmix64 with a fixed
+	// seed keeps it deterministic.
+	x := uint64(0x706c6578686f7374) // "plexhost"
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+func topBits(n int) uint64 {
+	return ((1 << n) - 1) << (64 - n)
+}
+
+// Chunker splits a stream into content defined chunks.
+type Chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func New(r io.Reader) *Chunker {
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, MaxSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF when the stream is exhausted. The
+// returned slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < MaxSize && !c.eof {
+		// Move what's left to the front and fill up the buffer
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the first chunk in b.
+func cut(b []byte) int {
+	if len(b) <= MinSize {
+		return len(b)
+	}
+	if len(b) > MaxSize {
+		b = b[:MaxSize]
+	}
+
+	var fp uint64
+	i := MinSize
+	for ; i < len(b) && i < AvgSize; i++ {
+		fp = (fp << 1) + gear[b[i]]
+		if fp&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < len(b); i++ {
+		fp = (fp << 1) + gear[b[i]]
+		if fp&maskL == 0 {
+			return i + 1
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,451 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/plexyhost/volume-driver/pkg/compression"
+)
+
+const snapshotVersion = 1
+
+// ErrCorrupt is returned for snapshots and chunks that can't be decoded or
+// don't match their checksum.
+var ErrCorrupt = errors.New("corrupt snapshot or chunk")
+
+// uploadWorkers is how many chunks are uploaded at the same time.
+const uploadWorkers = 4
+
+// ChunkStore is where the chunks are kept. It is implemented by the storage
+// providers supporting chunked backups.
+type ChunkStore interface {
+	HasChunk(sum string) (bool, error)
+	StoreChunk(sum string, src io.Reader) error
+	RetrieveChunk(sum string, dst io.Writer) error
+}
+
+// Snapshot describes a directory at a point in time. File contents are
+// referenced by the sha256 sums of their chunks.
+type Snapshot struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Files   []File    `json:"files"`
+}
+
+type File struct {
+	Name    string      `json:"name"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size"`
+	Link    string      `json:"link,omitempty"`
+	Chunks  []string    `json:"chunks,omitempty"`
+	// UID and GID are the owner, missing in snapshots from before they
+	// were recorded
+	UID int `json:"uid,omitempty"`
+	GID int `json:"gid,omitempty"`
+}
+
+// WriteTo writes the snapshot as zstd compressed JSON.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(encoder.EncodeAll(data, nil))
+	return int64(n), err
+}
+
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var s Snapshot
+	if err := json.NewDecoder(zr).Decode(&s); err != nil {
+		return nil, fmt.Errorf("%w: invalid snapshot: %w", ErrCorrupt, err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	return &s, nil
+}
+
+type BackupOptions struct {
+	// Exclude reports whether a slash separated path relative to the source
+	// is left out. Excluded directories are skipped entirely.
+	Exclude func(name string, isDir bool) bool
+
+	// Previous is the last snapshot of the same directory. Its chunks are
+	// known to exist, and files with the same size and modification time
+	// reuse its chunk list without being read.
+	Previous *Snapshot
+}
+
+type BackupStats struct {
+	Files          int
+	ReusedFiles    int
+	Chunks         int
+	UploadedChunks int
+	UploadedBytes  int64
+	SkippedFiles   int
+	SkippedBytes   int64
+}
+
+func (s *BackupStats) skip(file string, fi fs.FileInfo) {
+	var cs compression.Stats
+	cs.Skip(file, fi)
+	s.SkippedFiles += cs.SkippedFiles
+	s.SkippedBytes += cs.SkippedBytes
+}
+
+var (
+	encoder, _ = zstd.NewWriter(nil)
+	decoder, _ = zstd.NewReader(nil)
+)
+
+// Backup splits the files in src into chunks, uploads the chunks store
+// doesn't have yet and returns the snapshot. The snapshot itself isn't
+// stored anywhere, that's up to the caller.
+func Backup(src string, store ChunkStore, opts BackupOptions) (*Snapshot, BackupStats, error) {
+	var stats BackupStats
+
+	// Everything in the previous snapshot is known to be in the store
+	known := make(map[string]bool)
+	previous := make(map[string]File)
+	if opts.Previous != nil {
+		for _, f := range opts.Previous.Files {
+			previous[f.Name] = f
+			for _, sum := range f.Chunks {
+				known[sum] = true
+			}
+		}
+	}
+
+	up := newUploader(store, known)
+
+	snap := &Snapshot{Version: snapshotVersion, Created: time.Now()}
+	err := filepath.WalkDir(src, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == "." {
+			return nil
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+
+		if opts.Exclude != nil && opts.Exclude(name, fi.IsDir()) {
+			stats.skip(file, fi)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		f := File{
+			Name:    name,
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+		}
+		if uid, gid, ok := compression.FileOwner(fi); ok {
+			f.UID, f.GID = uid, gid
+		}
+
+		switch {
+		case fi.IsDir():
+		case fi.Mode()&fs.ModeSymlink != 0:
+			f.Link, err = os.Readlink(file)
+			if err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			f.Size = fi.Size()
+			if p, ok := previous[name]; ok && p.Size == f.Size && p.ModTime.Equal(f.ModTime) && p.Mode == f.Mode {
+				f.Chunks = p.Chunks
+				stats.ReusedFiles++
+				break
+			}
+			f.Chunks, err = up.file(file)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		default:
+			// Sockets, devices and the like can't be restored anyway
+			return nil
+		}
+
+		stats.Files++
+		stats.Chunks += len(f.Chunks)
+		snap.Files = append(snap.Files, f)
+		return nil
+	})
+
+	uerr := up.wait()
+	if err != nil {
+		return nil, stats, err
+	}
+	if uerr != nil {
+		return nil, stats, uerr
+	}
+
+	stats.UploadedChunks, stats.UploadedBytes = up.uploaded, up.uploadedBytes
+	return snap, stats, nil
+}
+
+// uploader uploads chunks in the background with a bounded number of
+// workers, skipping the ones the store already has.
+type uploader struct {
+	store ChunkStore
+	sem   chan struct{}
+	wg    sync.WaitGroup
+
+	mu            sync.Mutex
+	known         map[string]bool
+	err           error
+	uploaded      int
+	uploadedBytes int64
+}
+
+func newUploader(store ChunkStore, known map[string]bool) *uploader {
+	return &uploader{
+		store: store,
+		sem:   make(chan struct{}, uploadWorkers),
+		known: known,
+	}
+}
+
+// file chunks the file and queues the chunks for upload. It returns the sums
+// of the chunks.
+func (u *uploader) file(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sums []string
+	c := New(f)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha256.Sum256(chunk)
+		sum := hex.EncodeToString(h[:])
+		sums = append(sums, sum)
+
+		u.mu.Lock()
+		if u.err != nil {
+			err := u.err
+			u.mu.Unlock()
+			return nil, err
+		}
+		if u.known[sum] {
+			u.mu.Unlock()
+			continue
+		}
+		u.known[sum] = true
+		u.mu.Unlock()
+
+		// The chunk is only valid until the next call to Next
+		data := encoder.EncodeAll(chunk, make([]byte, 0, len(chunk)/2))
+
+		u.sem <- struct{}{}
+		u.wg.Add(1)
+		go func() {
+			defer func() {
+				<-u.sem
+				u.wg.Done()
+			}()
+			u.upload(sum, data)
+		}()
+	}
+	return sums, nil
+}
+
+func (u *uploader) upload(sum string, data []byte) {
+	exists, err := u.store.HasChunk(sum)
+	if err == nil && !exists {
+		err = u.store.StoreChunk(sum, bytes.NewReader(data))
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		if u.err == nil {
+			u.err = fmt.Errorf("chunk %s: %w", sum, err)
+		}
+		return
+	}
+	if !exists {
+		u.uploaded++
+		u.uploadedBytes += int64(len(data))
+	}
+}
+
+func (u *uploader) wait() error {
+	u.wg.Wait()
+	return u.err
+}
+
+// Restore writes the contents of snap into the empty directory dst, fetching
+// the chunks from store. It is as careful as compression.Decompress: entries
+// and links can't end up outside dst, the limits and id maps of opts apply,
+// and directory modes are set last, so read-only directories still get
+// their contents.
+func Restore(snap *Snapshot, store ChunkStore, dst string, opts compression.DecompressOptions) error {
+	// Only root can hand files to other users
+	chown := os.Geteuid() == 0
+
+	var dirs []File
+	var written int64
+	for i, f := range snap.Files {
+		if opts.MaxFiles > 0 && i+1 > opts.MaxFiles {
+			return fmt.Errorf("entry %q: more than %d files: %w", f.Name, opts.MaxFiles, compression.ErrLimitExceeded)
+		}
+
+		target, err := compression.SafeTarget(dst, f.Name)
+		if err != nil {
+			return err
+		}
+		if err := compression.ClearTarget(target, f.Mode.IsDir()); err != nil {
+			return err
+		}
+
+		switch {
+		case f.Mode.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, f)
+		case f.Mode&fs.ModeSymlink != 0:
+			if err := compression.CheckSymlink(f.Name, f.Link); err != nil {
+				return err
+			}
+			if err := os.Symlink(f.Link, target); err != nil {
+				return err
+			}
+		case f.Mode.IsRegular():
+			remaining := int64(-1)
+			if opts.MaxBytes > 0 {
+				remaining = opts.MaxBytes - written
+			}
+			n, err := restoreFile(f, store, target, remaining)
+			written += n
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			if opts.MaxBytes > 0 && written > opts.MaxBytes {
+				return fmt.Errorf("entry %q: more than %d bytes: %w", f.Name, opts.MaxBytes, compression.ErrLimitExceeded)
+			}
+		default:
+			continue
+		}
+
+		if chown {
+			uid, gid := opts.MapOwner(f.UID, f.GID)
+			if err := os.Lchown(target, uid, gid); err != nil {
+				return err
+			}
+		}
+		// Symlinks have no permissions of their own. Chmod comes after
+		// chown, as chown clears the setuid and setgid bits.
+		if f.Mode.IsRegular() {
+			if err := os.Chmod(target, f.Mode); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, f.ModTime, f.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Before directory modes are set, they may keep the walk out
+	if err := compression.CheckLinks(dst); err != nil {
+		return err
+	}
+
+	// Deepest directories first, so setting a time isn't undone by a child
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, err := compression.SafeTarget(dst, dirs[i].Name)
+		if err != nil {
+			return err
+		}
+		// Replaced by a later entry, which may be a symlink chmod follows
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := os.Chmod(target, dirs[i].Mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFile writes the chunks of f to target. It stops once more than
+// remaining bytes were written, unless remaining is negative, and returns
+// how many were.
+func restoreFile(f File, store ChunkStore, target string, remaining int64) (int64, error) {
+	// O_EXCL never follows a symlink at target
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	var buf bytes.Buffer
+	for _, sum := range f.Chunks {
+		buf.Reset()
+		if err := store.RetrieveChunk(sum, &buf); err != nil {
+			out.Close()
+			return written, fmt.Errorf("chunk %s: %w", sum, err)
+		}
+		chunk, err := decoder.DecodeAll(buf.Bytes(), nil)
+		if err != nil {
+			out.Close()
+			return written, fmt.Errorf("chunk %s: %w: %w", sum, ErrCorrupt, err)
+		}
+		if h := sha256.Sum256(chunk); hex.EncodeToString(h[:]) != sum {
+			out.Close()
+			return written, fmt.Errorf("chunk %s: %w: checksum mismatch", sum, ErrCorrupt)
+		}
+		n, err := out.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			out.Close()
+			return written, err
+		}
+		if remaining >= 0 && written > remaining {
+			break
+		}
+	}
+	return written, out.Close()
+}
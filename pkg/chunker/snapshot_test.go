@@ -0,0 +1,141 @@
+package chunker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/plexyhost/volume-driver/pkg/compression"
+)
+
+type memStore struct {
+	mu     sync.Mutex
+	chunks map[string][]byte
+}
+
+func (m *memStore) HasChunk(sum string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.chunks[sum]
+	return ok, nil
+}
+
+func (m *memStore) StoreChunk(sum string, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chunks[sum] = data
+	return nil
+}
+
+func (m *memStore) RetrieveChunk(sum string, dst io.Writer) error {
+	m.mu.Lock()
+	data, ok := m.chunks[sum]
+	m.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := dst.Write(data)
+	return err
+}
+
+func backup(t *testing.T) (*Snapshot, *memStore) {
+	t.Helper()
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "ro"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "ro", "f"), bytes.Repeat([]byte("x"), 1000), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "g"), []byte("g"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "ro"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(src, "ro"), 0755) })
+
+	store := &memStore{chunks: make(map[string][]byte)}
+	snap, _, err := Backup(src, store, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snap, store
+}
+
+func TestRestoreReadOnlyDir(t *testing.T) {
+	snap, store := backup(t)
+	dst := t.TempDir()
+	t.Cleanup(func() { os.Chmod(filepath.Join(dst, "ro"), 0755) })
+	if err := Restore(snap, store, dst, compression.DecompressOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "ro"))
+	if err != nil || fi.Mode().Perm() != 0555 {
+		t.Fatalf("directory mode %v, %v", fi.Mode(), err)
+	}
+	fi, err = os.Stat(filepath.Join(dst, "ro", "f"))
+	if err != nil || fi.Mode().Perm() != 0640 || fi.Size() != 1000 {
+		t.Fatalf("file %v, %v", fi, err)
+	}
+}
+
+func TestRestoreLimits(t *testing.T) {
+	snap, store := backup(t)
+	for _, opts := range []compression.DecompressOptions{
+		{MaxFiles: 2},
+		{MaxBytes: 1000},
+	} {
+		err := Restore(snap, store, t.TempDir(), opts)
+		if !errors.Is(err, compression.ErrLimitExceeded) {
+			t.Fatalf("%+v: expected ErrLimitExceeded, got %v", opts, err)
+		}
+	}
+	if err := Restore(snap, store, t.TempDir(), compression.DecompressOptions{MaxFiles: 3, MaxBytes: 1001}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	other := filepath.Join(dir, "othervol")
+	if err := os.MkdirAll(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(other, "level.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "vol")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memStore{chunks: make(map[string][]byte)}
+	snap := &Snapshot{Version: snapshotVersion, Files: []File{
+		{Name: "a", Mode: os.ModeDir | 0755},
+		{Name: "a/b", Mode: os.ModeSymlink | 0777, Link: ".."},
+		{Name: "c", Mode: os.ModeSymlink | 0777, Link: "a/b/../othervol/level.dat"},
+		{Name: "c", Mode: 0644},
+	}}
+	if err := Restore(snap, store, dst, compression.DecompressOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(other, "level.dat")); err != nil || string(data) != "world" {
+		t.Fatalf("other volume was written to: %q, %v", data, err)
+	}
+
+	// Left as a symlink, it escapes
+	snap.Files = snap.Files[:3]
+	err := Restore(snap, store, filepath.Join(dir, "vol2"), compression.DecompressOptions{})
+	if !errors.Is(err, compression.ErrUnsafeEntry) {
+		t.Fatalf("expected ErrUnsafeEntry, got %v", err)
+	}
+}
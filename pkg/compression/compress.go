@@ -2,32 +2,131 @@ package compression
 
 import (
 	"archive/tar"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 
-	"github.com/klauspost/compress/zstd"
+	"github.com/plexyhost/volume-driver/pkg/ignore"
 )
 
-func Compress(src string, dst io.Writer) error {
+type CompressOptions struct {
+	// Codec compresses the tar stream, zstd by default.
+	Codec Codec
+
+	// Level is within the bounds of Codec.Levels. Zero means the codec
+	// default.
+	Level int
+
+	// WindowSize is the zstd window size, a power of two between
+	// MinWindowSize and MaxWindowSize. Zero means the encoder default.
+	WindowSize int
+
+	// Concurrency is how many goroutines the zstd and lz4 encoders use. Zero
+	// means the encoder default.
+	Concurrency int
+
+	// Ignore holds the rules for what to leave out of the archive. Excluded
+	// directories are skipped entirely.
+	Ignore *ignore.Matcher
+}
+
+// Excluded reports whether the slash separated path name, relative to the
+// archived directory, is left out of the archive.
+func (o CompressOptions) Excluded(name string, isDir bool) bool {
+	// Ignore world/session.lock
+	if name == "world/session.lock" {
+		return true
+	}
+	return o.Ignore.Match(name, isDir)
+}
+
+// Stats is what ended up in an archive, and what was left out.
+type Stats struct {
+	Files        int
+	Bytes        int64
+	SkippedFiles int
+	SkippedBytes int64
+	// Cloned is how many files Stage reflinked instead of copying
+	Cloned int
+}
+
+// Skip records a skipped entry. The contents of skipped directories are
+// counted as well.
+func (s *Stats) Skip(file string, fi fs.FileInfo) {
+	if !fi.IsDir() {
+		s.SkippedFiles++
+		s.SkippedBytes += fi.Size()
+		return
+	}
+
+	_ = filepath.WalkDir(file, func(_ string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return nil
+		}
+		if info, err := e.Info(); err == nil {
+			s.SkippedFiles++
+			s.SkippedBytes += info.Size()
+		}
+		return nil
+	})
+}
+
+func Compress(src string, dst io.Writer, opts CompressOptions) (Stats, error) {
+	var stats Stats
+
 	// Writer chain
-	// tar -> gzip -> dst
-	// zr := gzip.NewWriter(dst)
-	zr, _ := zstd.NewWriter(dst)
+	// tar -> codec -> dst
+	zr, err := newWriter(dst, opts)
+	if err != nil {
+		return stats, err
+	}
 	tw := tar.NewWriter(zr)
 
-	err := filepath.WalkDir(src, func(file string, e fs.DirEntry, _ error) error {
-		// Construct header
+	// Files with several hard links are only stored once, the other names
+	// become link entries pointing at the first one
+	type inode struct{ dev, ino uint64 }
+	links := make(map[inode]string)
+
+	err = filepath.WalkDir(src, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			// The volume is live, files may disappear while we walk it
+			if vanished(err) && file != src {
+				return nil
+			}
+			return err
+		}
+
+		// Construct header. WalkDir doesn't follow symlinks, so this is
+		// the info of the link itself.
 		fi, err := e.Info()
 		if err != nil {
+			if vanished(err) {
+				return nil
+			}
 			return err
 		}
 
-		header, err := tar.FileInfoHeader(fi, file)
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			link, err = os.Readlink(file)
+			if err != nil {
+				if vanished(err) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(fi, link)
 		if err != nil {
 			return err
 		}
+		// PAX keeps sub-second modification times and xattrs
+		header.Format = tar.FormatPAX
 
 		// Make the header name relative to the src directory
 		header.Name, err = filepath.Rel(src, file)
@@ -35,38 +134,112 @@ func Compress(src string, dst io.Writer) error {
 			return err
 		}
 		header.Name = filepath.ToSlash(header.Name)
+		if fi.IsDir() && header.Name != "." {
+			header.Name += "/"
+		}
 
-		// Ignore world/session.lock
-		if header.Name == "world/session.lock" {
+		if header.Name != "." && opts.Excluded(strings.TrimSuffix(header.Name, "/"), fi.IsDir()) {
+			stats.Skip(file, fi)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		// Write header through writer chain
-		if err := tw.WriteHeader(header); err != nil {
-			return err
+		attrs, err := readXattrs(file)
+		if err != nil {
+			if vanished(err) {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+		for name, val := range attrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[paxXattr+name] = val
 		}
 
-		if !fi.IsDir() {
-			data, err := os.Open(file)
+		// Opened before anything is written, so a file that is gone by now
+		// can still be left out
+		var data *os.File
+		if fi.Mode().IsRegular() {
+			data, err = os.Open(file)
 			if err != nil {
+				if vanished(err) {
+					return nil
+				}
 				return err
 			}
 			defer data.Close()
-			if _, err := io.Copy(tw, data); err != nil {
-				return err
+
+			if dev, ino, linked := fileID(fi); linked {
+				if first, ok := links[inode{dev, ino}]; ok {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = first
+					header.Size = 0
+				} else {
+					links[inode{dev, ino}] = header.Name
+				}
+			}
+		}
+
+		// Write header through writer chain
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			n, err := copyEntry(tw, data, header.Size)
+			if err != nil {
+				return fmt.Errorf("%s: %w", header.Name, err)
 			}
+			stats.Bytes += n
+		}
+		if !fi.IsDir() {
+			stats.Files++
 		}
 		return nil
 	})
 
 	if err != nil {
-		return err
+		return stats, err
 	}
 
 	// Close the writer chain
 	if err := tw.Close(); err != nil {
-		return err
+		return stats, err
 	}
 
-	return zr.Close()
+	return stats, zr.Close()
+}
+
+// copyEntry copies exactly size bytes of a file that may be written to while
+// it's archived. Whatever it grew by is left out, and if it shrank the entry
+// is padded with zeros, like GNU tar does, as the header is already written.
+// It returns how many bytes were read from the file.
+func copyEntry(tw io.Writer, data io.Reader, size int64) (int64, error) {
+	n, err := io.Copy(tw, io.LimitReader(data, size))
+	if err != nil {
+		return n, err
+	}
+	if n < size {
+		if _, err := io.CopyN(tw, zeros{}, size-n); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// vanished reports whether err means a file was removed while it was being
+// archived or staged.
+func vanished(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
 }
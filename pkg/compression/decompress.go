@@ -2,31 +2,81 @@ package compression
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-
-	"github.com/klauspost/compress/zstd"
+	"strings"
 )
 
-func Decompress(src io.Reader, dst string) error {
+// IDMap maps a range of uids or gids in the archive to the ids they get on
+// disk, like the user namespace maps of a rootless container.
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// mapID maps id through the first range containing it. Ids outside every
+// range are kept as they are.
+func mapID(maps []IDMap, id int) int {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID
+		}
+	}
+	return id
+}
+
+type DecompressOptions struct {
+	// UIDMap and GIDMap remap the ownership of the extracted files.
+	UIDMap []IDMap
+	GIDMap []IDMap
+
+	// MaxBytes and MaxFiles cap the total size and number of the extracted
+	// entries, as a defence against decompression bombs. Zero means no limit.
+	MaxBytes int64
+	MaxFiles int
+
+	// TempDir is where the archive is extracted before it replaces dst, see
+	// Replace.
+	TempDir string
+}
+
+// MapOwner returns the ids a file owned by uid and gid in the archive gets on
+// disk.
+func (o DecompressOptions) MapOwner(uid, gid int) (int, int) {
+	return mapID(o.UIDMap, uid), mapID(o.GIDMap, gid)
+}
 
+// Decompress replaces dst with the contents of the archive. The archive is
+// extracted into a staging directory first, dst is only touched once the
+// whole archive has been read successfully.
+func Decompress(src io.Reader, dst string, opts DecompressOptions) error {
+	return Replace(dst, opts.TempDir, func(staging string) error {
+		return extract(src, staging, opts)
+	})
+}
+
+func extract(src io.Reader, dst string, opts DecompressOptions) error {
 	// Reader chain
-	// src -> gzip -> tar
-	// gr, err := gzip.NewReader(src)
-	gr, err := zstd.NewReader(src)
+	// src -> codec -> tar
+	gr, err := newReader(src)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
 	}
 	defer gr.Close()
 
-	tr := tar.NewReader(gr)
+	tr := tar.NewReader(corruptReader{gr})
 
-	// Clear directory
-	if err := os.RemoveAll(dst); err != nil {
-		return err
-	}
+	// Only root can hand files to other users
+	chown := os.Geteuid() == 0
+
+	// Directory times are set last, as creating their contents changes them
+	var dirs []*tar.Header
+
+	var files int
+	var written int64
 
 	for {
 		header, err := tr.Next()
@@ -34,30 +84,159 @@ func Decompress(src io.Reader, dst string) error {
 			break // End of archive
 		}
 		if err != nil {
-			return err
+			return fmt.Errorf("%w: %w", ErrCorrupt, err)
 		}
 
-		target := filepath.Join(dst, header.Name)
+		files++
+		if opts.MaxFiles > 0 && files > opts.MaxFiles {
+			return fmt.Errorf("entry %q: more than %d files: %w", header.Name, opts.MaxFiles, ErrLimitExceeded)
+		}
+
+		target, err := SafeTarget(dst, header.Name)
+		if err != nil {
+			return err
+		}
+		if err := ClearTarget(target, header.Typeflag == tar.TypeDir); err != nil {
+			return err
+		}
 		switch header.Typeflag {
 		case tar.TypeDir:
 			// Create directory
-			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+			if err := os.MkdirAll(target, 0755); err != nil {
 				return err
 			}
+			dirs = append(dirs, header)
 		case tar.TypeReg:
-			// Create file
-			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, os.FileMode(header.Mode))
+			// Create file. O_EXCL never follows a symlink at target.
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			// The header size can't be trusted, so count what is actually
+			// written
+			var src io.Reader = corruptReader{tr}
+			if opts.MaxBytes > 0 {
+				src = corruptReader{io.LimitReader(tr, opts.MaxBytes-written+1)}
+			}
+			n, err := io.Copy(file, src)
+			written += n
 			if err != nil {
+				file.Close()
 				return err
 			}
-			if _, err := io.Copy(file, tr); err != nil {
+			if opts.MaxBytes > 0 && written > opts.MaxBytes {
 				file.Close()
+				return fmt.Errorf("entry %q: more than %d bytes: %w", header.Name, opts.MaxBytes, ErrLimitExceeded)
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := CheckSymlink(header.Name, header.Linkname); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := SafeTarget(dst, header.Linkname)
+			if err != nil {
+				return fmt.Errorf("entry %q: hard link: %w", header.Name, err)
+			}
+			if err := os.Link(source, target); err != nil {
 				return err
 			}
-			file.Close()
+			// A hard link shares everything with its target
+			continue
 		default:
 			return fmt.Errorf("unsupported type: %v", header.Typeflag)
 		}
+
+		if chown {
+			uid, gid := opts.MapOwner(header.Uid, header.Gid)
+			if err := os.Lchown(target, uid, gid); err != nil {
+				return err
+			}
+		}
+
+		if err := writeXattrs(target, xattrs(header)); err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+
+		// Directories might not be writable once their mode is set
+		if header.Typeflag != tar.TypeDir {
+			if err := setModeAndTimes(target, header); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Before directory modes are set, they may keep the walk out
+	if err := CheckLinks(dst); err != nil {
+		return err
+	}
+
+	// Deepest directories first, so setting a time isn't undone by a child
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, err := SafeTarget(dst, dirs[i].Name)
+		if err != nil {
+			return err
+		}
+		// Replaced by a later entry, which may be a symlink chmod follows
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := setModeAndTimes(target, dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	// A stream cut off at a tar header boundary looks like a complete
+	// archive, so make sure the compressed stream ended properly as well.
+	// Uncompressed archives have nothing to check this against.
+	if _, err := io.Copy(io.Discard, gr); err != nil {
+		return fmt.Errorf("%w: archive is incomplete: %w", ErrCorrupt, err)
 	}
 	return nil
 }
+
+// setModeAndTimes applies the permissions and times of header to target. It
+// has to run after chown, as chown clears the setuid and setgid bits.
+func setModeAndTimes(target string, header *tar.Header) error {
+	// Symlinks have no permissions of their own
+	if header.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(target, header.FileInfo().Mode()); err != nil {
+			return err
+		}
+	}
+
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	return lchtimes(target, atime, header.ModTime)
+}
+
+func xattrs(header *tar.Header) map[string]string {
+	attrs := make(map[string]string)
+	for key, val := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattr); ok {
+			attrs[name] = val
+		}
+	}
+	return attrs
+}
+
+// corruptReader marks read errors as ErrCorrupt, to tell them apart from
+// errors writing the extracted files.
+type corruptReader struct {
+	r io.Reader
+}
+
+func (c corruptReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF && !errors.Is(err, ErrCorrupt) {
+		err = fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	return n, err
+}
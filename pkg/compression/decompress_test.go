@@ -0,0 +1,23 @@
+package compression
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecompressTruncated(t *testing.T) {
+	full := archive(t, entry{name: "f", data: string(bytes.Repeat([]byte("x"), 4096)), typ: tar.TypeReg})
+	// Cut off in the middle of the file contents
+	cut := bytes.NewReader(full.Bytes()[:full.Len()/2])
+
+	for _, opts := range []DecompressOptions{{}, {MaxBytes: 1 << 20}} {
+		cut.Seek(0, 0)
+		err := Decompress(cut, filepath.Join(t.TempDir(), "vol"), opts)
+		if !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("%+v: expected ErrCorrupt, got %v", opts, err)
+		}
+	}
+}
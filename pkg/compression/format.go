@@ -0,0 +1,194 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Archives start with a small header naming the codec of the tar stream that
+// follows:
+//
+//	magic   4 bytes  "PLXA"
+//	version 1 byte
+//	codec   1 byte
+//
+// Archives written before the header existed are plain zstd streams. The zstd
+// frame magic never starts with "PLXA", so they are told apart by peeking.
+var magic = []byte("PLXA")
+
+const (
+	formatVersion = 1
+	headerSize    = len("PLXA") + 2
+)
+
+// Codec is the compression applied to the tar stream of an archive.
+type Codec uint8
+
+const (
+	// The zero Codec is zstd, the codec of archives without a header.
+	CodecZstd Codec = iota
+	CodecGzip
+	CodecLZ4
+	CodecNone
+)
+
+var codecNames = map[Codec]string{
+	CodecZstd: "zstd",
+	CodecGzip: "gzip",
+	CodecLZ4:  "lz4",
+	CodecNone: "none",
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// ParseCodec returns the codec with the given name.
+func ParseCodec(name string) (Codec, error) {
+	for c, n := range codecNames {
+		if strings.EqualFold(name, n) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q", name)
+}
+
+// Levels returns the bounds of the compression levels of c. Codecs without
+// levels return 0, 0.
+func (c Codec) Levels() (min, max int) {
+	switch c {
+	case CodecZstd:
+		return 1, 22
+	case CodecGzip:
+		return gzip.BestSpeed, gzip.BestCompression
+	case CodecLZ4:
+		return 1, 9
+	}
+	return 0, 0
+}
+
+const (
+	// MinWindowSize and MaxWindowSize bound the zstd window size.
+	MinWindowSize = zstd.MinWindowSize
+	MaxWindowSize = 1 << 29
+)
+
+// newWriter writes the archive header to dst and returns the compressing
+// writer for the tar stream.
+func newWriter(dst io.Writer, opts CompressOptions) (io.WriteCloser, error) {
+	if _, ok := codecNames[opts.Codec]; !ok {
+		return nil, fmt.Errorf("unknown codec %v", opts.Codec)
+	}
+	if _, err := dst.Write(append(bytes.Clone(magic), formatVersion, byte(opts.Codec))); err != nil {
+		return nil, err
+	}
+
+	switch opts.Codec {
+	case CodecGzip:
+		level := gzip.DefaultCompression
+		if opts.Level != 0 {
+			level = opts.Level
+		}
+		return gzip.NewWriterLevel(dst, level)
+	case CodecLZ4:
+		w := lz4.NewWriter(dst)
+		lopts := []lz4.Option{lz4.ChecksumOption(true)}
+		if opts.Level != 0 {
+			lopts = append(lopts, lz4.CompressionLevelOption(lz4.CompressionLevel(1<<(8+opts.Level))))
+		}
+		if opts.Concurrency != 0 {
+			lopts = append(lopts, lz4.ConcurrencyOption(opts.Concurrency))
+		}
+		if err := w.Apply(lopts...); err != nil {
+			return nil, err
+		}
+		return w, nil
+	case CodecNone:
+		return nopWriteCloser{dst}, nil
+	}
+
+	var zopts []zstd.EOption
+	if opts.Level != 0 {
+		zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+	}
+	if opts.WindowSize != 0 {
+		zopts = append(zopts, zstd.WithWindowSize(opts.WindowSize))
+	}
+	if opts.Concurrency != 0 {
+		zopts = append(zopts, zstd.WithEncoderConcurrency(opts.Concurrency))
+	}
+	return zstd.NewWriter(dst, zopts...)
+}
+
+// newReader reads the archive header from src, if there is one, and returns
+// the decompressing reader for the tar stream.
+func newReader(src io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(src)
+	header, err := br.Peek(headerSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	codec := CodecZstd
+	if bytes.HasPrefix(header, magic) {
+		if len(header) < headerSize {
+			return nil, fmt.Errorf("archive header is incomplete")
+		}
+		if v := header[len(magic)]; v != formatVersion {
+			return nil, fmt.Errorf("unsupported archive version %d", v)
+		}
+		codec = Codec(header[len(magic)+1])
+		if _, err := br.Discard(headerSize); err != nil {
+			return nil, err
+		}
+	}
+
+	switch codec {
+	case CodecZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CodecGzip:
+		gr, err := gzip.NewReader(br)
+		return gr, err
+	case CodecLZ4:
+		return io.NopCloser(&stickyEOF{r: lz4.NewReader(br)}), nil
+	case CodecNone:
+		return io.NopCloser(br), nil
+	}
+	return nil, fmt.Errorf("unknown codec %v", codec)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// stickyEOF keeps returning io.EOF once r did. The lz4 reader fails when it's
+// read again after the end of the stream.
+type stickyEOF struct {
+	r   io.Reader
+	eof bool
+}
+
+func (s *stickyEOF) Read(p []byte) (int, error) {
+	if s.eof {
+		return 0, io.EOF
+	}
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
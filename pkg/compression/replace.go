@@ -0,0 +1,117 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Staging directories are named .<base of dst>.restore-<random>, and the old
+// contents of dst are moved to the same name with .old appended.
+const (
+	restoreInfix = ".restore-"
+	oldSuffix    = ".old"
+)
+
+// Replace fills a staging directory in tmp and swaps it into place at dst
+// once fill succeeds. tmp must be on the same filesystem as dst, empty means
+// the directory of dst. The previous contents of dst are kept until the swap
+// is done, so a failed or interrupted restore never leaves dst half written.
+// Sweep cleans up after restores that were killed.
+func Replace(dst, tmp string, fill func(staging string) error) error {
+	dst = filepath.Clean(dst)
+	parent, base := filepath.Split(dst)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	if tmp == "" {
+		tmp = parent
+	}
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp(tmp, "."+base+restoreInfix)
+	if err != nil {
+		return err
+	}
+	// Does nothing once the staging directory has been renamed to dst
+	defer os.RemoveAll(staging)
+
+	// MkdirTemp creates the directory as 0700, keep the mode of dst
+	mode := os.FileMode(0755)
+	if fi, err := os.Stat(dst); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(staging, mode); err != nil {
+		return err
+	}
+
+	if err := fill(staging); err != nil {
+		return err
+	}
+
+	// Move the old contents out of the way, and back again if the swap fails
+	old := ""
+	if _, err := os.Lstat(dst); err == nil {
+		old = staging + oldSuffix
+		if err := os.Rename(dst, old); err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", dst, err)
+		}
+	}
+
+	if err := os.Rename(staging, dst); err != nil {
+		if old != "" {
+			if rerr := os.Rename(old, dst); rerr != nil {
+				return fmt.Errorf("failed to swap in %s: %w, and to move the old contents back: %v", dst, err, rerr)
+			}
+		}
+		return fmt.Errorf("failed to swap in %s: %w", dst, err)
+	}
+
+	if old != "" {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+// Sweep removes what Replace calls that were killed left in tmp, for
+// destinations in parent. When the old contents of a destination were moved
+// aside but the new ones never swapped in, they're moved back instead, as
+// they're all that is left. It must not run while Replace does.
+func Sweep(tmp, parent string) error {
+	entries, err := os.ReadDir(tmp)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, e := range entries {
+		name := e.Name()
+		i := strings.LastIndex(name, restoreInfix)
+		if !strings.HasPrefix(name, ".") || i < 1 {
+			continue
+		}
+		path := filepath.Join(tmp, name)
+
+		if strings.HasSuffix(name, oldSuffix) {
+			dst := filepath.Join(parent, name[1:i])
+			if _, err := os.Lstat(dst); errors.Is(err, fs.ErrNotExist) {
+				if err := os.Rename(path, dst); err != nil {
+					errs = append(errs, err)
+				}
+				continue
+			}
+		}
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
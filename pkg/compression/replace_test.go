@@ -0,0 +1,66 @@
+package compression
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSweep(t *testing.T) {
+	parent := t.TempDir()
+	tmp := filepath.Join(parent, ".state")
+	for _, dir := range []string{
+		"vol",
+		".state/.vol.restore-1",
+		".state/.vol.restore-1.old",
+		".state/.gone.restore-2",
+		".state/.gone.restore-2.old",
+		".state/other",
+	} {
+		if err := os.MkdirAll(filepath.Join(parent, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmp, ".gone.restore-2.old", "level.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Sweep(tmp, parent); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, gone := range []string{".vol.restore-1", ".vol.restore-1.old", ".gone.restore-2", ".gone.restore-2.old"} {
+		if _, err := os.Lstat(filepath.Join(tmp, gone)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left: %v", gone, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "other")); err != nil {
+		t.Error("unrelated entry removed")
+	}
+	// The old contents were all that was left of gone
+	if data, err := os.ReadFile(filepath.Join(parent, "gone", "level.dat")); err != nil || string(data) != "world" {
+		t.Errorf("old contents not moved back: %q, %v", data, err)
+	}
+}
+
+func TestReplaceTempDir(t *testing.T) {
+	parent := t.TempDir()
+	tmp := filepath.Join(parent, ".state")
+	dst := filepath.Join(parent, "vol")
+	err := Replace(dst, tmp, func(staging string) error {
+		if filepath.Dir(staging) != tmp {
+			t.Errorf("staged in %s", staging)
+		}
+		return os.WriteFile(filepath.Join(staging, "f"), []byte("x"), 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "f")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Fatalf("left in tmp: %v", entries)
+	}
+}
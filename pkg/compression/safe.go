@@ -0,0 +1,155 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrUnsafeEntry is returned for entries that would end up outside the
+	// directory being extracted to.
+	ErrUnsafeEntry = errors.New("entry resolves outside the destination")
+	// ErrLimitExceeded is returned when an archive is bigger than the limits
+	// in DecompressOptions.
+	ErrLimitExceeded = errors.New("archive exceeds the extraction limits")
+	// ErrCorrupt is returned when the archive can't be read, because it's
+	// damaged, cut off or not an archive at all.
+	ErrCorrupt = errors.New("corrupt archive")
+)
+
+// SafeTarget returns where the slash separated entry name ends up in root.
+// Names that are absolute or climb out of root are rejected, and so are
+// names going through a symlink in root, as the symlink could point anywhere.
+func SafeTarget(root, name string) (string, error) {
+	rel := filepath.FromSlash(name)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("entry %q: %w", name, ErrUnsafeEntry)
+	}
+	rel = filepath.Clean(rel)
+
+	// Archives never contain entries below a symlink, as the archiver doesn't
+	// follow them. Anything that does is crafted.
+	dir := root
+	parts := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+	for _, p := range parts {
+		if p == "." {
+			continue
+		}
+		dir = filepath.Join(dir, p)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("entry %q goes through symlink %q: %w", name, p, ErrUnsafeEntry)
+		}
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// CheckSymlink rejects symlinks whose target is absolute or climbs out of the
+// directory being extracted to. name and link are slash separated. It only
+// looks at the link as text, symlinks extracted later can still make it
+// resolve elsewhere, so CheckLinks must check the extracted tree.
+func CheckSymlink(name, link string) error {
+	if path.IsAbs(link) || !filepath.IsLocal(filepath.FromSlash(path.Join(path.Dir(name), link))) {
+		return fmt.Errorf("entry %q links to %q: %w", name, link, ErrUnsafeEntry)
+	}
+	return nil
+}
+
+// maxLinks bounds how many symlinks are followed resolving one path, like
+// the kernel does, so link loops are rejected.
+const maxLinks = 40
+
+// CheckLinks rejects trees in root with symlinks that resolve outside of
+// root, following the other symlinks in root on the way. Links are checked
+// once everything is extracted, as a later link can change where an earlier
+// one points to.
+func CheckLinks(root string) error {
+	return filepath.WalkDir(root, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		name, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		return resolveInRoot(root, filepath.ToSlash(name))
+	})
+}
+
+// resolveInRoot follows the slash separated name in root the way the kernel
+// would, and fails if that leaves root.
+func resolveInRoot(root, name string) error {
+	var resolved []string
+	todo := strings.Split(name, "/")
+	links := 0
+	for len(todo) > 0 {
+		p := todo[0]
+		todo = todo[1:]
+		switch p {
+		case "", ".":
+			continue
+		case "..":
+			// resolved has no symlinks, so its parent is what the kernel
+			// finds too
+			if len(resolved) == 0 {
+				return fmt.Errorf("entry %q resolves outside the volume: %w", name, ErrUnsafeEntry)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		next := filepath.Join(root, filepath.Join(resolved...), p)
+		fi, err := os.Lstat(next)
+		// Missing entries and files can't redirect the rest of the path
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, p)
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return fmt.Errorf("entry %q: too many levels of symlinks: %w", name, ErrUnsafeEntry)
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return err
+		}
+		if path.IsAbs(link) {
+			return fmt.Errorf("entry %q resolves outside the volume: %w", name, ErrUnsafeEntry)
+		}
+		todo = append(strings.Split(link, "/"), todo...)
+	}
+	return nil
+}
+
+// ClearTarget removes whatever an earlier entry with the same name left at
+// target, so a new entry is never written through a symlink. Directories
+// are kept for directory entries, only the entry's metadata changes.
+func ClearTarget(target string, isDir bool) error {
+	fi, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isDir && fi.IsDir() {
+		return nil
+	}
+	return os.RemoveAll(target)
+}
@@ -0,0 +1,155 @@
+package compression
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type entry struct {
+	name, link, data string
+	typ              byte
+	mode             int64
+}
+
+func archive(t *testing.T, entries ...entry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newWriter(&buf, CompressOptions{Codec: CodecNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.typ, Mode: e.mode, Size: int64(len(e.data))}
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// endpoint lays out a driver directory with the volume being restored and
+// another volume next to it.
+func endpoint(t *testing.T) (dst, other string) {
+	t.Helper()
+	dir := t.TempDir()
+	other = filepath.Join(dir, "othervol")
+	if err := os.MkdirAll(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(other, "level.dat"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "vol"), other
+}
+
+func checkUntouched(t *testing.T, other string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(other, "level.dat"))
+	if err != nil || string(data) != "world" {
+		t.Fatalf("other volume was written to: %q, %v", data, err)
+	}
+	fi, err := os.Stat(other)
+	if err != nil || fi.Mode().Perm() != 0755 {
+		t.Fatalf("other volume mode changed: %v, %v", fi.Mode(), err)
+	}
+}
+
+func TestDecompressFileThroughSymlink(t *testing.T) {
+	dst, other := endpoint(t)
+	// c reads as a/othervol/level.dat, but a/b is ..
+	buf := archive(t,
+		entry{name: "a/", typ: tar.TypeDir, mode: 0755},
+		entry{name: "a/b", link: "..", typ: tar.TypeSymlink},
+		entry{name: "c", link: "a/b/../othervol/level.dat", typ: tar.TypeSymlink},
+		entry{name: "c", data: "pwned", typ: tar.TypeReg},
+	)
+	if err := Decompress(buf, dst, DecompressOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkUntouched(t, other)
+
+	// The entry replaced the symlink
+	data, err := os.ReadFile(filepath.Join(dst, "c"))
+	if err != nil || string(data) != "pwned" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestDecompressDirThroughSymlink(t *testing.T) {
+	dst, other := endpoint(t)
+	buf := archive(t,
+		entry{name: "a/", typ: tar.TypeDir, mode: 0755},
+		entry{name: "a/b", link: "..", typ: tar.TypeSymlink},
+		entry{name: "c", link: "a/b/../othervol", typ: tar.TypeSymlink},
+		entry{name: "c/", typ: tar.TypeDir, mode: 0777},
+	)
+	if err := Decompress(buf, dst, DecompressOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkUntouched(t, other)
+}
+
+func TestDecompressEscapingSymlink(t *testing.T) {
+	dst, other := endpoint(t)
+	for _, entries := range [][]entry{
+		{
+			{name: "a/", typ: tar.TypeDir, mode: 0755},
+			{name: "a/b", link: "..", typ: tar.TypeSymlink},
+			{name: "c", link: "a/b/../othervol/level.dat", typ: tar.TypeSymlink},
+		},
+		// The link that makes c escape comes after it
+		{
+			{name: "c", link: "a/b/../othervol", typ: tar.TypeSymlink},
+			{name: "a/", typ: tar.TypeDir, mode: 0755},
+			{name: "a/b", link: "..", typ: tar.TypeSymlink},
+		},
+		{
+			{name: "loop", link: "loop", typ: tar.TypeSymlink},
+		},
+	} {
+		err := Decompress(archive(t, entries...), dst, DecompressOptions{})
+		if !errors.Is(err, ErrUnsafeEntry) {
+			t.Fatalf("expected ErrUnsafeEntry, got %v", err)
+		}
+		checkUntouched(t, other)
+		if _, err := os.Lstat(dst); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("failed restore was swapped in: %v", err)
+		}
+	}
+}
+
+func TestDecompressInsideSymlinks(t *testing.T) {
+	dst, _ := endpoint(t)
+	buf := archive(t,
+		entry{name: "world/", typ: tar.TypeDir, mode: 0755},
+		entry{name: "world/level.dat", data: "level", typ: tar.TypeReg},
+		entry{name: "a/", typ: tar.TypeDir, mode: 0755},
+		entry{name: "a/b", link: "..", typ: tar.TypeSymlink},
+		entry{name: "current", link: "a/b/world/level.dat", typ: tar.TypeSymlink},
+		entry{name: "dangling", link: "missing/file", typ: tar.TypeSymlink},
+	)
+	if err := Decompress(buf, dst, DecompressOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "current"))
+	if err != nil || string(data) != "level" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
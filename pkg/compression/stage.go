@@ -0,0 +1,241 @@
+package compression
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Stage copies src to dst, which must not exist yet, so it can be archived
+// while src keeps changing. Regular files are reflinked where the filesystem
+// supports it, which is instant, takes no extra space and can't tear. They
+// are copied otherwise, and copied again if they changed while being copied,
+// up to copyAttempts times. A file that keeps changing is staged as it was
+// last copied, and can still be torn. Files are staged one after the other,
+// so the copy isn't a point in time snapshot of the whole volume either.
+//
+// Excluded files are left out, and files that disappear while staging are
+// skipped. Sockets, devices and the like aren't staged.
+func Stage(src, dst string, opts CompressOptions) (Stats, error) {
+	var stats Stats
+
+	// Files with several hard links are staged once and linked again
+	type inode struct{ dev, ino uint64 }
+	links := make(map[inode]string)
+
+	// Directory modes and times are set last, as staging their contents
+	// changes them and they might not be writable anymore
+	type stagedDir struct {
+		path string
+		fi   fs.FileInfo
+	}
+	var dirs []stagedDir
+
+	err := filepath.WalkDir(src, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if vanished(err) && file != src {
+				return nil
+			}
+			return err
+		}
+
+		name, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		fi, err := e.Info()
+		if err != nil {
+			if vanished(err) {
+				return nil
+			}
+			return err
+		}
+
+		if name != "." && opts.Excluded(name, fi.IsDir()) {
+			stats.Skip(file, fi)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		switch {
+		case fi.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, stagedDir{target, fi})
+
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				if vanished(err) {
+					return nil
+				}
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+
+		case fi.Mode().IsRegular():
+			dev, ino, linked := fileID(fi)
+			if first, ok := links[inode{dev, ino}]; linked && ok {
+				// A hard link shares everything with its target
+				stats.Files++
+				return os.Link(first, target)
+			}
+			staged, n, cloned, err := stageFile(file, target)
+			if err != nil {
+				if vanished(err) {
+					return nil
+				}
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			// It may have changed since it was walked
+			fi = staged
+			if linked {
+				links[inode{dev, ino}] = target
+			}
+			stats.Bytes += n
+			if cloned {
+				stats.Cloned++
+			}
+
+		default:
+			return nil
+		}
+
+		if !fi.IsDir() {
+			stats.Files++
+		}
+		if err := stageMetadata(file, target, fi); err != nil {
+			if vanished(err) {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	// Deepest directories first, so setting a time isn't undone by a child
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].fi.Mode()); err != nil {
+			return stats, err
+		}
+		if err := lchtimes(dirs[i].path, dirs[i].fi.ModTime(), dirs[i].fi.ModTime()); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// copyAttempts is how often stageFile copies a file that changes while it's
+// copied.
+const copyAttempts = 3
+
+// stageFile reflinks or copies the file src to dst. It returns the info of
+// src as it was staged, the number of bytes staged and whether they were
+// reflinked.
+func stageFile(src, dst string) (fs.FileInfo, int64, bool, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	var n int64
+	cloned := cloneFile(out, in) == nil
+	if cloned {
+		var staged fs.FileInfo
+		if staged, err = out.Stat(); err == nil {
+			n = staged.Size()
+		}
+	} else {
+		fi, n, err = copyFile(out, in, fi)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return fi, n, cloned, err
+}
+
+// copyFile copies in, which had the info fi, to out until it's the same
+// before and after the copy. It returns the info of in as it was copied.
+func copyFile(out, in *os.File, fi fs.FileInfo) (fs.FileInfo, int64, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := io.Copy(out, in)
+		if err != nil {
+			return fi, n, err
+		}
+		after, err := in.Stat()
+		if err != nil {
+			return fi, n, err
+		}
+		if attempt >= copyAttempts || (after.Size() == fi.Size() && after.ModTime().Equal(fi.ModTime())) {
+			return after, n, nil
+		}
+
+		// Written to while copying, start over
+		fi = after
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return fi, n, err
+		}
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return fi, n, err
+		}
+		if err := out.Truncate(0); err != nil {
+			return fi, n, err
+		}
+	}
+}
+
+// stageMetadata gives the staged target the owner, xattrs, mode and times
+// file had when it was walked. The modes and times of directories are set
+// by Stage once their contents are staged.
+func stageMetadata(file, target string, fi fs.FileInfo) error {
+	// Only root can hand files to other users, for everyone else the
+	// archive records the staging user, as it would for restored files
+	if uid, gid, ok := FileOwner(fi); ok && os.Geteuid() == 0 {
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	attrs, err := readXattrs(file)
+	if err != nil {
+		return err
+	}
+	if err := writeXattrs(target, attrs); err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return nil
+	}
+	// Symlinks have no permissions of their own. Chmod comes after chown,
+	// as chown clears the setuid and setgid bits.
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		if err := os.Chmod(target, fi.Mode()); err != nil {
+			return err
+		}
+	}
+	return lchtimes(target, fi.ModTime(), fi.ModTime())
+}
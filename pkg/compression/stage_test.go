@@ -0,0 +1,47 @@
+package compression
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileChanged(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Info from before the file was written to
+	stale, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("written to"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	fi, n, err := copyFile(out, in, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 10 || n != 10 {
+		t.Fatalf("got size %d, copied %d", fi.Size(), n)
+	}
+	// Copied again from the start, not appended
+	data, err := os.ReadFile(out.Name())
+	if err != nil || string(data) != "written to" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,99 @@
+package compression
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// paxXattr is the PAX record prefix GNU tar and bsdtar use for xattrs.
+const paxXattr = "SCHILY.xattr."
+
+// fileID returns the device and inode of fi, and whether it has other hard
+// links pointing to it.
+func fileID(fi fs.FileInfo) (dev, ino uint64, linked bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), st.Ino, st.Nlink > 1
+}
+
+// FileOwner returns the uid and gid owning fi, if the platform has them.
+func FileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// cloneFile makes dst share the data of src with a reflink (FICLONE). It
+// fails on filesystems without reflinks and across filesystems.
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]string)
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			// Removed while we were looking
+			if errors.Is(err, unix.ENODATA) {
+				continue
+			}
+			return nil, err
+		}
+		val := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(path, name, val)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = string(val[:vsize])
+	}
+	return attrs, nil
+}
+
+func writeXattrs(path string, attrs map[string]string) error {
+	for name, val := range attrs {
+		err := unix.Lsetxattr(path, name, []byte(val), 0)
+		// Unsupported filesystems and namespaces we aren't allowed to write,
+		// like trusted.* without CAP_SYS_ADMIN, aren't worth failing over
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lchtimes is os.Chtimes without following symlinks.
+func lchtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package compression
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+const paxXattr = "SCHILY.xattr."
+
+func fileID(fi fs.FileInfo) (dev, ino uint64, linked bool) {
+	return 0, 0, false
+}
+
+func FileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func cloneFile(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
+
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func writeXattrs(path string, attrs map[string]string) error {
+	return nil
+}
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return os.Chtimes(path, atime, mtime)
+}
@@ -0,0 +1,189 @@
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Matcher matches slash separated paths against gitignore style rules:
+//
+//   - A pattern without a slash matches at any depth, one with a slash is
+//     relative to the root. A leading slash only anchors the pattern.
+//   - A trailing slash only matches directories.
+//   - * and ? match within a path segment, ** matches any number of segments.
+//   - A leading ! re-includes what earlier rules excluded. The last matching
+//     rule wins.
+//
+// Like git, a file can't be re-included if its directory is excluded, as the
+// directory is never walked.
+type Matcher struct {
+	rules []rule
+}
+
+type rule struct {
+	pattern string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// New compiles the rules. Empty lines and lines starting with # are skipped.
+func New(lines ...string) (*Matcher, error) {
+	m := &Matcher{}
+	if err := m.Add(lines...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Parse reads rules from r, one per line, like a .gitignore file.
+func Parse(r io.Reader) (*Matcher, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return New(lines...)
+}
+
+// Add appends rules after the existing ones, so they take precedence.
+func (m *Matcher) Add(lines ...string) error {
+	for _, line := range lines {
+		r, ok, err := compile(line)
+		if err != nil {
+			return err
+		}
+		if ok {
+			m.rules = append(m.rules, r)
+		}
+	}
+	return nil
+}
+
+// Include appends patterns that re-include paths, the same as adding them
+// with a leading !.
+func (m *Matcher) Include(patterns ...string) error {
+	for _, p := range patterns {
+		if err := m.Add("!" + p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge appends the rules of o after the rules of m.
+func (m *Matcher) Merge(o *Matcher) {
+	if o != nil {
+		m.rules = append(m.rules, o.rules...)
+	}
+}
+
+// Match reports whether the slash separated path name is excluded.
+func (m *Matcher) Match(name string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	excluded := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(name) {
+			excluded = !r.negate
+		}
+	}
+	return excluded
+}
+
+func (m *Matcher) String() string {
+	if m == nil {
+		return ""
+	}
+	patterns := make([]string, len(m.rules))
+	for i, r := range m.rules {
+		patterns[i] = r.pattern
+	}
+	return strings.Join(patterns, ",")
+}
+
+func compile(line string) (rule, bool, error) {
+	r := rule{pattern: strings.TrimSpace(line)}
+	p := strings.TrimRight(line, " \t\r")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return r, false, nil
+	}
+
+	switch {
+	case strings.HasPrefix(p, "!"):
+		r.negate = true
+		p = p[1:]
+	case strings.HasPrefix(p, `\!`), strings.HasPrefix(p, `\#`):
+		p = p[1:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return r, false, fmt.Errorf("invalid pattern %q: nothing to match", line)
+	}
+
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			// Zero or more directories
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**") && i+2 == len(p):
+			// Everything below
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return r, false, fmt.Errorf("invalid pattern %q: unterminated [", line)
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(p):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(p[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return r, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+	}
+	r.re = re
+	return r, true, nil
+}
@@ -0,0 +1,157 @@
+package rcon
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Packet types of the Source RCON protocol, which Minecraft speaks as well.
+// Auth responses share their type with commands.
+const (
+	typeResponse     = 0
+	typeCommand      = 2
+	typeAuthResponse = 2
+	typeAuth         = 3
+)
+
+// maxPacketSize guards against garbage from something that isn't an RCON
+// server. Minecraft splits responses into packets of at most 4096 bytes.
+const maxPacketSize = 64 * 1024
+
+// ErrAuth means the server rejected the password.
+var ErrAuth = errors.New("rcon: authentication failed")
+
+// Conn is an authenticated RCON connection. Commands are sent one at a time.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int32
+}
+
+// Dial connects to the RCON server at addr and logs in with password.
+func Dial(ctx context.Context, addr, password string) (*Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: nc, r: bufio.NewReader(nc)}
+
+	if err := c.auth(ctx, password); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) auth(ctx context.Context, password string) error {
+	defer c.watch(ctx)()
+
+	id, err := c.send(typeAuth, password)
+	if err != nil {
+		return err
+	}
+	// Source servers send an empty response before the auth response,
+	// Minecraft doesn't
+	for {
+		p, err := c.read()
+		if err != nil {
+			return err
+		}
+		if p.typ != typeAuthResponse {
+			continue
+		}
+		if p.id == -1 {
+			return ErrAuth
+		}
+		if p.id != id {
+			return fmt.Errorf("rcon: auth response for request %d, expected %d", p.id, id)
+		}
+		return nil
+	}
+}
+
+// Command runs cmd and returns the response. Minecraft only responds once
+// the command is done, so this also waits for e.g. save-all flush to finish.
+// Responses split over several packets are cut off after the first one.
+func (c *Conn) Command(ctx context.Context, cmd string) (string, error) {
+	defer c.watch(ctx)()
+
+	id, err := c.send(typeCommand, cmd)
+	if err != nil {
+		return "", err
+	}
+	for {
+		p, err := c.read()
+		if err != nil {
+			return "", err
+		}
+		// Left over from an earlier command that timed out
+		if p.id != id || p.typ != typeResponse {
+			continue
+		}
+		return p.body, nil
+	}
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// watch applies the deadline of ctx to the connection, and interrupts it
+// when ctx is cancelled. The returned function undoes that.
+func (c *Conn) watch(ctx context.Context) func() {
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() { stop() }
+}
+
+type packet struct {
+	id   int32
+	typ  int32
+	body string
+}
+
+// send writes a packet and returns its request id.
+func (c *Conn) send(typ int32, body string) (int32, error) {
+	c.id++
+	// id, type, body and two terminating zero bytes
+	buf := make([]byte, 4+4+4+len(body)+2)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)-4))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(c.id))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(typ))
+	copy(buf[12:], body)
+	if _, err := c.conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return c.id, nil
+}
+
+func (c *Conn) read() (packet, error) {
+	var size int32
+	if err := binary.Read(c.r, binary.LittleEndian, &size); err != nil {
+		return packet{}, err
+	}
+	if size < 10 || size > maxPacketSize {
+		return packet{}, fmt.Errorf("rcon: invalid packet size %d", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return packet{}, err
+	}
+	return packet{
+		id:  int32(binary.LittleEndian.Uint32(buf[0:])),
+		typ: int32(binary.LittleEndian.Uint32(buf[4:])),
+		// Without the two terminating zero bytes
+		body: string(buf[8 : size-2]),
+	}, nil
+}
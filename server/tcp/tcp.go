@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -10,6 +11,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/plexyhost/volume-driver/storage"
 )
 
 // Function to handle file cleanup after the upload is complete
@@ -42,7 +45,7 @@ func handleConn(conn net.Conn) {
 		return
 	}
 	log.Println("Received command line:", cmdLine)
-	parts := strings.Split(strings.TrimSpace(cmdLine), ":")
+	parts := strings.SplitN(strings.TrimSpace(cmdLine), ":", 2)
 	if len(parts) != 2 {
 		log.Println("Wrong command format:", cmdLine)
 		return
@@ -59,7 +62,8 @@ func handleConn(conn net.Conn) {
 			return
 		}
 		defer outFile.Close()
-		written, err := io.Copy(outFile, r)
+		cw := storage.NewChecksumWriter(outFile)
+		written, err := io.Copy(cw, r)
 		if err != nil {
 			log.Println("Error copying data:", err)
 			return
@@ -68,6 +72,9 @@ func handleConn(conn net.Conn) {
 			log.Println("Error finalizing file:", err)
 			return
 		}
+		if err := storage.WriteChecksum(id+".plex", cw.Sum()); err != nil {
+			log.Println("Error saving checksum:", err)
+		}
 		log.Println("File stored successfully for ID:", id)
 		log.Println("Written bytes:", written)
 		conn.Write([]byte("OK\n"))
@@ -78,6 +85,7 @@ func handleConn(conn net.Conn) {
 		f, err := os.Open(id + ".plex")
 		if err != nil {
 			log.Println("Error:", err)
+			replyError(conn, err)
 			return
 		}
 		defer f.Close()
@@ -86,11 +94,72 @@ func handleConn(conn net.Conn) {
 		log.Println("File retrieved successfully for ID:", id)
 		log.Println("Bytes stored:", n)
 
+	case "STAT":
+		id := parts[1]
+		fi, err := os.Stat(id + ".plex")
+		if err != nil {
+			log.Println("Error:", err)
+			replyError(conn, err)
+			return
+		}
+		replyJSON(conn, storage.FileObject(id, id+".plex", fi))
+
+	case "DELETE":
+		id := parts[1]
+		if err := os.Remove(id + ".plex"); err != nil {
+			log.Println("Error:", err)
+			replyError(conn, err)
+			return
+		}
+		os.Remove(id + ".plex" + storage.ChecksumSuffix)
+		log.Println("File deleted for ID:", id)
+		conn.Write([]byte("OK\n"))
+
+	case "LIST":
+		entries, err := os.ReadDir(".")
+		if err != nil {
+			log.Println("Error:", err)
+			replyError(conn, err)
+			return
+		}
+		objs := []storage.Object{}
+		for _, e := range entries {
+			id, ok := strings.CutSuffix(e.Name(), ".plex")
+			if !ok || e.IsDir() {
+				continue
+			}
+			if fi, err := e.Info(); err == nil {
+				objs = append(objs, storage.FileObject(id, e.Name(), fi))
+			}
+		}
+		replyJSON(conn, objs)
+
 	default:
 		log.Println("Unknown event received")
 	}
 }
 
+// replyError tells the client what went wrong. Missing files get their own
+// status, so the client can tell them apart.
+func replyError(conn net.Conn, err error) {
+	if os.IsNotExist(err) {
+		conn.Write([]byte("NOTFOUND\n"))
+		return
+	}
+	fmt.Fprintf(conn, "ERROR %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+// replyJSON answers with OK and v on a single line.
+func replyJSON(conn net.Conn, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		replyError(conn, err)
+		return
+	}
+	conn.Write([]byte("OK\n"))
+	conn.Write(append(data, '\n'))
+}
+
 func main() {
 	log.Println("Starting TCP server on :30000")
 	ln, err := net.Listen("tcp", ":30000")
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var chunkSumPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// MaxChunkSize bounds chunks, compressed or not. The chunker cuts them at
+// 1 MiB at most, and zstd barely grows data it can't compress.
+const MaxChunkSize = 2 << 20
+
+var chunkDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxChunkSize))
+
+// ValidChunkSum reports whether sum is a hex encoded sha256 sum. Sums end up
+// in file names and URLs, so anything else is refused.
+func ValidChunkSum(sum string) bool {
+	return chunkSumPattern.MatchString(sum)
+}
+
+// VerifyChunk checks that data is a zstd compressed chunk, as the chunker
+// stores them, whose contents have the sha256 sum. Chunks are never uploaded
+// twice, so a damaged one would break every snapshot using it.
+func VerifyChunk(sum string, data []byte) error {
+	chunk, err := chunkDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return &Error{Op: "verify chunk", ID: sum, Kind: ErrCorrupt, Err: err}
+	}
+	if h := sha256.Sum256(chunk); hex.EncodeToString(h[:]) != sum {
+		return &Error{Op: "verify chunk", ID: sum, Kind: ErrCorrupt, Err: errors.New("checksum mismatch")}
+	}
+	return nil
+}
@@ -1,9 +1,176 @@
 package storage
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The kinds of storage errors. Providers return them wrapped in an *Error,
+// check for them with errors.Is.
+var (
+	// ErrNotFound means there is no archive under the id. It matches
+	// os.ErrNotExist as well.
+	ErrNotFound = fmt.Errorf("not found: %w", os.ErrNotExist)
+	// ErrConflict means the store was refused because of the current state
+	// of the archive
+	ErrConflict = errors.New("conflict")
+	// ErrUnauthorized means the credentials were missing or refused
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrUnavailable means the storage can't be reached right now. These
+	// errors are worth retrying.
+	ErrUnavailable = errors.New("storage unavailable")
+	// ErrCorrupt means the data or the response was damaged or unreadable
+	ErrCorrupt = errors.New("corrupt data")
+	// ErrNotModified means the archive didn't change since the version the
+	// caller already has
+	ErrNotModified = errors.New("not modified")
+)
 
 var (
-	// This isn't actually an error. It is just a cheap way to bypass writing the whole shit again to disk, handled in the driver.
-	ErrCacheHit = errors.New("cache has been hit. this is good btw 👍")
-	ErrNon200   = errors.New("non-200 response from http storage provider")
+	ErrNon200       = errors.New("non-200 response from http storage provider")
+	ErrInvalidChunk = errors.New("invalid chunk sum")
 )
+
+// Error is a failed storage operation.
+type Error struct {
+	// Op is the operation, e.g. "store" or "retrieve"
+	Op string
+	// ID is the archive id or chunk sum, if any
+	ID string
+	// Kind is one of the Err variables above, nil if the failure doesn't fit
+	// any of them
+	Kind error
+	// Err is the underlying error, if any
+	Err error
+	// RetryAfter is how long the server asked to wait before trying again,
+	// zero if it didn't say
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := e.Op
+	if e.ID != "" {
+		msg += " " + e.ID
+	}
+	switch {
+	case e.Kind != nil && e.Err != nil:
+		return fmt.Sprintf("%s: %v: %v", msg, e.Kind, e.Err)
+	case e.Kind != nil:
+		return fmt.Sprintf("%s: %v", msg, e.Kind)
+	default:
+		return fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+}
+
+func (e *Error) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// Retryable reports whether err is worth retrying.
+func Retryable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
+
+// wrap turns err into an *Error of the operation, working out its kind from
+// the error itself. Errors that already are an *Error and context errors are
+// returned as they are.
+func wrap(op, id string, err error) error {
+	var serr *Error
+	if err == nil || errors.As(err, &serr) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &Error{Op: op, ID: id, Kind: kindOf(err), Err: err}
+}
+
+func kindOf(err error) error {
+	// Requests fail with a *url.Error, which is a net.Error itself even when
+	// it's the request body that failed
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return kindOf(urlErr.Err)
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ErrNotFound
+	case errors.Is(err, os.ErrExist):
+		return ErrConflict
+	case errors.Is(err, os.ErrPermission):
+		return ErrUnauthorized
+	case errors.As(err, &netErr),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// statusKind maps an HTTP status code to the kind of error it stands for.
+func statusKind(code int) error {
+	switch code {
+	case http.StatusNotModified:
+		return ErrNotModified
+	case http.StatusNotFound, http.StatusGone:
+		return ErrNotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return ErrConflict
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return ErrUnavailable
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return ErrCorrupt
+	}
+	if code >= 500 {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// statusError turns an unexpected response into an *Error, with the response
+// body as detail.
+func statusError(op, id string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	return &Error{
+		Op:         op,
+		ID:         id,
+		Kind:       statusKind(res.StatusCode),
+		Err:        errors.Join(ErrNon200, fmt.Errorf("code %d: %s", res.StatusCode, string(body))),
+		RetryAfter: retryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or a date.
+func retryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
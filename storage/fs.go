@@ -1,18 +1,46 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"io"
+	"net/url"
 	"os"
+	"sort"
 	"strings"
 )
 
+// legacySuffix is what archives were stored as before they got the .plex
+// suffix. They are still read, but never written.
+const legacySuffix = ".tar.gz"
+
 type fsStorage struct {
 	root   string
 	suffix string
 }
 
-func NewFSStorage(root string) Provider {
-	os.MkdirAll(root, os.ModeDir)
+func init() {
+	Register(Backend{
+		Schemes: []string{"file"},
+		New: func(ep *url.URL) (Provider, error) {
+			// file:///srv/plex is absolute, file:plex is relative
+			root := ep.Path
+			if ep.Opaque != "" {
+				root = ep.Opaque
+			}
+			if ep.Host != "" && ep.Host != "localhost" {
+				return nil, errors.New("file endpoints can't have a host")
+			}
+			if root == "" {
+				return nil, errors.New("file endpoints need a path")
+			}
+			return NewFSStorage(root), nil
+		},
+	})
+}
+
+func NewFSStorage(root string) ChunkProvider {
+	os.MkdirAll(root, 0755)
 
 	if !strings.HasSuffix(root, "/") {
 		root += "/"
@@ -20,21 +48,202 @@ func NewFSStorage(root string) Provider {
 
 	return fsStorage{
 		root:   root,
-		suffix: ".tar.gz",
+		suffix: ".plex",
 	}
 }
 
-func (fs fsStorage) Store(id string, src io.Reader) error {
-	f, err := os.Create(fs.root + id + fs.suffix)
+func (fs fsStorage) Store(ctx context.Context, id string, src io.Reader) error {
+	return wrap("store", id, fs.store(ctx, id, src))
+}
+
+func (fs fsStorage) store(ctx context.Context, id string, src io.Reader) error {
+	path := fs.root + id + fs.suffix
+
+	// Write under a temporary name, so a failed or cancelled store leaves
+	// the previous archive in place
+	f, err := os.CreateTemp(fs.root, id+".*.tmp")
 	if err != nil {
 		return err
 	}
-	_, err = f.ReadFrom(src)
+	defer os.Remove(f.Name())
+
+	cw := NewChecksumWriter(f)
+	_, err = io.Copy(cw, ctxReader{ctx, src})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return WriteChecksum(path, cw.Sum())
+}
+
+// path returns the file archive id is stored in, which is the legacy name
+// if only that one exists.
+func (fs fsStorage) path(id string) string {
+	path := fs.root + id + fs.suffix
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		if _, err := os.Lstat(fs.root + id + legacySuffix); err == nil {
+			return fs.root + id + legacySuffix
+		}
+	}
+	return path
+}
+
+func (fs fsStorage) Retrieve(ctx context.Context, id string, dst io.Writer) error {
+	return wrap("retrieve", id, fs.retrieve(ctx, id, dst))
+}
+
+func (fs fsStorage) retrieve(ctx context.Context, id string, dst io.Writer) error {
+	f, err := os.Open(fs.path(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(ctxWriter{ctx, dst}, f)
 	return err
 }
 
-func (fs fsStorage) Retrieve(id string, dst io.Writer) error {
-	f, err := os.Open(fs.root + id + fs.suffix)
+func (fs fsStorage) Stat(ctx context.Context, id string) (Object, error) {
+	path := fs.path(id)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Object{}, wrap("stat", id, err)
+	}
+	return FileObject(id, path, fi), nil
+}
+
+func (fs fsStorage) Delete(ctx context.Context, id string) error {
+	return wrap("delete", id, fs.delete(ctx, id))
+}
+
+func (fs fsStorage) delete(ctx context.Context, id string) error {
+	var errs []error
+	found := false
+	for _, path := range []string{fs.root + id + fs.suffix, fs.root + id + legacySuffix} {
+		err := os.Remove(path)
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		if err := os.Remove(path + ChecksumSuffix); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	if !found && len(errs) == 0 {
+		return os.ErrNotExist
+	}
+	return errors.Join(errs...)
+}
+
+func (fs fsStorage) List(ctx context.Context) ([]Object, error) {
+	entries, err := os.ReadDir(fs.root)
+	if err != nil {
+		return nil, wrap("list", "", err)
+	}
+
+	objs := make(map[string]Object)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		id, ok := strings.CutSuffix(name, fs.suffix)
+		legacy := false
+		if !ok {
+			if id, ok = strings.CutSuffix(name, legacySuffix); !ok {
+				continue
+			}
+			legacy = true
+		}
+		// The new archive wins over the legacy one
+		if _, seen := objs[id]; seen && legacy {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		objs[id] = FileObject(id, fs.root+name, fi)
+	}
+
+	list := make([]Object, 0, len(objs))
+	for _, obj := range objs {
+		list = append(list, obj)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (fs fsStorage) chunkPath(sum string) string {
+	return fs.root + "chunks/" + sum
+}
+
+func (fs fsStorage) HasChunk(sum string) (bool, error) {
+	if !ValidChunkSum(sum) {
+		return false, ErrInvalidChunk
+	}
+	_, err := os.Stat(fs.chunkPath(sum))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, wrap("check chunk", sum, err)
+}
+
+func (fs fsStorage) StoreChunk(sum string, src io.Reader) error {
+	return wrap("store chunk", sum, fs.storeChunk(sum, src))
+}
+
+func (fs fsStorage) storeChunk(sum string, src io.Reader) error {
+	if !ValidChunkSum(sum) {
+		return ErrInvalidChunk
+	}
+	if err := os.MkdirAll(fs.root+"chunks", 0755); err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(src, MaxChunkSize+1))
+	if err != nil {
+		return err
+	}
+	// Chunks the store has are never uploaded again, so a damaged one would
+	// stay for good
+	if err := VerifyChunk(sum, data); err != nil {
+		return err
+	}
+
+	// Chunks are immutable, write them under a temporary name so a failed
+	// write never leaves a partial chunk behind
+	f, err := os.CreateTemp(fs.root+"chunks", sum+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fs.chunkPath(sum))
+}
+
+func (fs fsStorage) RetrieveChunk(sum string, dst io.Writer) error {
+	return wrap("retrieve chunk", sum, fs.retrieveChunk(sum, dst))
+}
+
+func (fs fsStorage) retrieveChunk(sum string, dst io.Writer) error {
+	if !ValidChunkSum(sum) {
+		return ErrInvalidChunk
+	}
+	f, err := os.Open(fs.chunkPath(sum))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func chunk(t *testing.T, data string) (sum string, body []byte) {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:]), enc.EncodeAll([]byte(data), nil)
+}
+
+func TestStoreChunkVerifies(t *testing.T) {
+	root := t.TempDir() + "/"
+	fs := fsStorage{root: root, suffix: ".plex"}
+	sum, body := chunk(t, "region data")
+	_, other := chunk(t, "other data")
+
+	for name, bad := range map[string][]byte{
+		"mismatch":  other,
+		"truncated": body[:len(body)/2],
+		"raw":       []byte("region data"),
+	} {
+		err := fs.StoreChunk(sum, bytes.NewReader(bad))
+		if !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("%s: expected ErrCorrupt, got %v", name, err)
+		}
+		if ok, err := fs.HasChunk(sum); ok || err != nil {
+			t.Fatalf("%s: damaged chunk stored: %v", name, err)
+		}
+	}
+
+	// A damaged chunk from before is replaced
+	if err := os.MkdirAll(root+"chunks", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fs.chunkPath(sum), other, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.StoreChunk(sum, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := fs.RetrieveChunk(sum, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyChunk(sum, got.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
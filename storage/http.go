@@ -1,122 +1,256 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/log"
 )
 
 type httpStorage struct {
-	cl           *http.Client
-	endpoint     *url.URL
-	lastRetrieve map[string]time.Time
-	mu           *sync.Mutex
-	// checksums is a map that points any server id to the sum
+	cl       *http.Client
+	endpoint *url.URL
 }
 
-func NewHTTPStorage(endpoint string) (Provider, error) {
+func init() {
+	Register(Backend{
+		Schemes: []string{"http", "https"},
+		Options: map[string]string{
+			"timeout": "Limit on each request, including the transfer, e.g. 10m",
+		},
+		New: func(ep *url.URL) (Provider, error) {
+			cl := &http.Client{}
+			q := ep.Query()
+			if v := q.Get("timeout"); v != "" {
+				timeout, err := time.ParseDuration(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid timeout %q: %w", v, err)
+				}
+				cl.Timeout = timeout
+			}
+
+			// The options are meant for us, not for the storage server
+			base := *ep
+			base.RawQuery = ""
+			return &httpStorage{cl: cl, endpoint: &base}, nil
+		},
+	})
+}
+
+func NewHTTPStorage(endpoint string) (ChunkProvider, error) {
 	ep, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
 	}
 
 	return &httpStorage{
-		cl:           &http.Client{},
-		endpoint:     ep,
-		lastRetrieve: make(map[string]time.Time),
-		mu:           &sync.Mutex{},
+		cl:       &http.Client{},
+		endpoint: ep,
 	}, nil
 }
 
-func (hs *httpStorage) Store(id string, src io.Reader) error {
-
-	// Tror simpelthen ikke der ka ske nogle væsentlige ændringer på 3 sekunder...
-	// så vi antager der ikke er, for at skippe den Docker
-	// fejl, hvor når man mounter trigger den et mount, unmount og så igen et mount :)
-	hs.mu.Lock()
-	defer hs.mu.Unlock()
-	if lastFetch, ok := hs.lastRetrieve[id]; ok {
-		if since := time.Since(lastFetch); since < 10*time.Second {
-			log.Warn("Determining no changes since lastFetch", "since", since)
-			return ErrCacheHit
+// do sends the request and returns the response if it has one of the
+// expected status codes. Anything else is turned into an *Error.
+func (hs *httpStorage) do(r *http.Request, op, id string, expect ...int) (*http.Response, error) {
+	res, err := hs.cl.Do(r)
+	if err != nil {
+		return nil, wrap(op, id, err)
+	}
+	for _, code := range expect {
+		if res.StatusCode == code {
+			return res, nil
 		}
 	}
+	defer res.Body.Close()
+	return nil, statusError(op, id, res)
+}
 
+func (hs *httpStorage) Store(ctx context.Context, id string, src io.Reader) error {
 	ep := hs.endpoint.JoinPath("data", id)
-	r, err := http.NewRequest("PUT", ep.String(), src)
+	r, err := http.NewRequestWithContext(ctx, "PUT", ep.String(), src)
 	if err != nil {
 		return err
 	}
 	r.Header.Add("Content-Type", "binary/octet-stream")
 
-	res, err := hs.cl.Do(r)
+	res, err := hs.do(r, "store", id, http.StatusOK)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
+	return res.Body.Close()
+}
 
-	if res.StatusCode == 200 {
-		return nil
+func (hs *httpStorage) Retrieve(ctx context.Context, id string, dst io.Writer) error {
+	ep := hs.endpoint.JoinPath("data", id)
+	r, err := http.NewRequestWithContext(ctx, "GET", ep.String(), nil)
+	if err != nil {
+		return err
 	}
+	log.Info("GETTING", "ep", ep.String())
 
-	d, err := io.ReadAll(res.Body)
+	res, err := hs.do(r, "retrieve", id, http.StatusOK)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	return errors.Join(ErrNon200, fmt.Errorf("code received while storing: %d. Data: %s", res.StatusCode, string(d)))
+	if _, err := io.Copy(dst, res.Body); err != nil {
+		return wrap("retrieve", id, err)
+	}
+	return nil
 }
 
-func (hs *httpStorage) Retrieve(id string, dst io.Writer) error {
-	hs.mu.Lock()
-	defer hs.mu.Unlock()
-	if lastFetch, ok := hs.lastRetrieve[id]; ok {
-		if since := time.Since(lastFetch); since < 10*time.Second {
-			log.Warn("Determining no changes since lastFetch", "since", since)
-			return ErrCacheHit
-		}
+// RetrieveIfChanged sends version as If-None-Match, the server answers 304
+// if the archive still has that ETag.
+func (hs *httpStorage) RetrieveIfChanged(ctx context.Context, id, version string, dst io.Writer) (string, error) {
+	ep := hs.endpoint.JoinPath("data", id)
+	r, err := http.NewRequestWithContext(ctx, "GET", ep.String(), nil)
+	if err != nil {
+		return "", err
 	}
+	if version != "" {
+		r.Header.Set("If-None-Match", `"`+version+`"`)
+	}
+
+	res, err := hs.do(r, "retrieve", id, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
 
+	if _, err := io.Copy(dst, res.Body); err != nil {
+		return "", wrap("retrieve", id, err)
+	}
+	return strings.Trim(res.Header.Get("ETag"), `"`), nil
+}
+
+// Stat uses the headers of a HEAD request, see cmd/server.
+func (hs *httpStorage) Stat(ctx context.Context, id string) (Object, error) {
 	ep := hs.endpoint.JoinPath("data", id)
-	r, err := http.NewRequest("GET", ep.String(), nil)
-	log.Info("GETTING", "ep", ep.String())
+	r, err := http.NewRequestWithContext(ctx, "HEAD", ep.String(), nil)
+	if err != nil {
+		return Object{}, err
+	}
 
+	res, err := hs.do(r, "stat", id, http.StatusOK)
 	if err != nil {
-		return err
+		return Object{}, err
 	}
+	defer res.Body.Close()
 
-	res, err := hs.cl.Do(r)
+	obj := Object{
+		ID:       id,
+		Size:     res.ContentLength,
+		Checksum: res.Header.Get("X-Checksum-Sha256"),
+		Version:  strings.Trim(res.Header.Get("ETag"), `"`),
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		obj.ModTime = t
+	}
+	return obj, nil
+}
+
+func (hs *httpStorage) Delete(ctx context.Context, id string) error {
+	ep := hs.endpoint.JoinPath("data", id)
+	r, err := http.NewRequestWithContext(ctx, "DELETE", ep.String(), nil)
+	if err != nil {
+		return err
+	}
 
+	res, err := hs.do(r, "delete", id, http.StatusOK, http.StatusNoContent)
 	if err != nil {
 		return err
 	}
+	return res.Body.Close()
+}
+
+func (hs *httpStorage) List(ctx context.Context) ([]Object, error) {
+	ep := hs.endpoint.JoinPath("data")
+	r, err := http.NewRequestWithContext(ctx, "GET", ep.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := hs.do(r, "list", "", http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
 	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		if res.StatusCode == 404 {
-			log.Info("Status 404, ignoring...")
-			return os.ErrNotExist
-		}
-		dat, err2 := io.ReadAll(res.Body)
-		if err2 != nil {
-			return err
-		}
-		return errors.Join(ErrNon200, fmt.Errorf("code received while retrieving: %d. Data: %s", res.StatusCode, string(dat)))
+	var objs []Object
+	if err := json.NewDecoder(res.Body).Decode(&objs); err != nil {
+		return nil, &Error{Op: "list", Kind: ErrCorrupt, Err: err}
+	}
+	return objs, nil
+}
+
+func (hs *httpStorage) HasChunk(sum string) (bool, error) {
+	if !ValidChunkSum(sum) {
+		return false, ErrInvalidChunk
+	}
+
+	ep := hs.endpoint.JoinPath("chunks", sum)
+	r, err := http.NewRequest("HEAD", ep.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := hs.do(r, "check chunk", sum, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
+	res.Body.Close()
+	return true, nil
+}
+
+func (hs *httpStorage) StoreChunk(sum string, src io.Reader) error {
+	if !ValidChunkSum(sum) {
+		return ErrInvalidChunk
+	}
+
+	ep := hs.endpoint.JoinPath("chunks", sum)
+	r, err := http.NewRequest("PUT", ep.String(), src)
+	if err != nil {
+		return err
+	}
+	r.Header.Add("Content-Type", "binary/octet-stream")
+
+	res, err := hs.do(r, "store chunk", sum, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
 
-	hs.lastRetrieve[id] = time.Now()
+func (hs *httpStorage) RetrieveChunk(sum string, dst io.Writer) error {
+	if !ValidChunkSum(sum) {
+		return ErrInvalidChunk
+	}
 
-	_, err = io.Copy(dst, res.Body)
+	ep := hs.endpoint.JoinPath("chunks", sum)
+	r, err := http.NewRequest("GET", ep.String(), nil)
 	if err != nil {
 		return err
 	}
 
+	res, err := hs.do(r, "retrieve chunk", sum, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if _, err := io.Copy(dst, res.Body); err != nil {
+		return wrap("retrieve chunk", sum, err)
+	}
 	return nil
 }
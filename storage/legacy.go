@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Legacy adapts a LegacyProvider to the Provider interface. Contexts are only
+// checked before each call and between reads and writes, as the provider
+// can't be interrupted otherwise. Stat, Delete and List return
+// errors.ErrUnsupported.
+func Legacy(p LegacyProvider) Provider {
+	return legacyProvider{p}
+}
+
+type legacyProvider struct {
+	p LegacyProvider
+}
+
+func (l legacyProvider) Store(ctx context.Context, id string, src io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return wrap("store", id, l.p.Store(id, ctxReader{ctx, src}))
+}
+
+func (l legacyProvider) Retrieve(ctx context.Context, id string, dst io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return wrap("retrieve", id, l.p.Retrieve(id, ctxWriter{ctx, dst}))
+}
+
+func (l legacyProvider) Stat(_ context.Context, id string) (Object, error) {
+	return Object{}, &Error{Op: "stat", ID: id, Err: errors.ErrUnsupported}
+}
+
+func (l legacyProvider) Delete(_ context.Context, id string) error {
+	return &Error{Op: "delete", ID: id, Err: errors.ErrUnsupported}
+}
+
+func (l legacyProvider) List(context.Context) ([]Object, error) {
+	return nil, &Error{Op: "list", Err: errors.ErrUnsupported}
+}
+
+// ctxReader fails reads once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ctxWriter fails writes once ctx is done.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c ctxWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// ChecksumSuffix is appended to the name of an archive for the file holding
+// its sha256 sum, written by the fs provider and the storage servers.
+const ChecksumSuffix = ".sha256"
+
+// FileObject describes the archive id stored in the file at path. The
+// checksum is read from the file next to it, if there is one.
+func FileObject(id, path string, fi os.FileInfo) Object {
+	obj := Object{
+		ID:      id,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Version: fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+	}
+	if sum, err := os.ReadFile(path + ChecksumSuffix); err == nil {
+		obj.Checksum = strings.TrimSpace(string(sum))
+	}
+	return obj
+}
+
+// ChecksumWriter hashes everything written through it, to be saved with
+// WriteChecksum once the archive is complete.
+type ChecksumWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func NewChecksumWriter(w io.Writer) *ChecksumWriter {
+	return &ChecksumWriter{w: w, h: sha256.New()}
+}
+
+func (c *ChecksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+// Sum returns the hex encoded sha256 sum of what was written.
+func (c *ChecksumWriter) Sum() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+// WriteChecksum saves sum next to the archive at path.
+func WriteChecksum(path, sum string) error {
+	return os.WriteFile(path+ChecksumSuffix, []byte(sum+"\n"), 0644)
+}
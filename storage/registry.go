@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend is a kind of storage provider, selected by the scheme of an
+// endpoint URL. Backend specific options are passed as URL query parameters,
+// e.g. tcp://host:4000?timeout=10s.
+type Backend struct {
+	Schemes []string
+	// Options maps the query parameters the backend accepts to a short
+	// description. Any other parameter is rejected.
+	Options map[string]string
+	// New creates a provider for an endpoint with a known scheme and only
+	// known options.
+	New func(endpoint *url.URL) (Provider, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Backend)
+)
+
+// Register makes a backend available under its schemes. It panics if a
+// scheme is already taken, like database/sql.Register.
+func Register(b Backend) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, scheme := range b.Schemes {
+		scheme = strings.ToLower(scheme)
+		if _, ok := registry[scheme]; ok {
+			panic("storage: backend registered twice for scheme " + scheme)
+		}
+		registry[scheme] = b
+	}
+}
+
+// Schemes returns the registered schemes, sorted.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open creates the provider for endpoint, picked by its scheme.
+func Open(endpoint string) (Provider, error) {
+	u, b, err := lookup(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	p, err := b.New(u)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %q: %w", endpoint, err)
+	}
+	return p, nil
+}
+
+// Check validates endpoint like Open does, without creating a provider.
+func Check(endpoint string) error {
+	_, _, err := lookup(endpoint)
+	return err
+}
+
+func lookup(endpoint string) (*url.URL, Backend, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, Backend{}, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme == "" {
+		return nil, Backend{}, fmt.Errorf("invalid endpoint %q: missing scheme, expected one of %s", endpoint, strings.Join(Schemes(), ", "))
+	}
+
+	registryMu.RLock()
+	b, ok := registry[strings.ToLower(u.Scheme)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, Backend{}, fmt.Errorf("invalid endpoint %q: unknown scheme %q, expected one of %s", endpoint, u.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	for key := range u.Query() {
+		if _, ok := b.Options[key]; !ok {
+			return nil, Backend{}, fmt.Errorf("invalid endpoint %q: unknown option %q for scheme %s", endpoint, key, u.Scheme)
+		}
+	}
+	return u, b, nil
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Retry metrics, keyed by operation. They are served on /debug/vars when the
+// driver is started with a metrics address.
+var (
+	metricAttempts = expvar.NewMap("storage_attempts")
+	metricRetries  = expvar.NewMap("storage_retries")
+	metricFailures = expvar.NewMap("storage_failures")
+)
+
+type RetryOptions struct {
+	// Attempts is how often an operation is tried in total, at least 1
+	Attempts int
+	// BaseDelay is the wait before the first retry. It doubles with every
+	// retry, up to MaxDelay, and is jittered.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// AttemptTimeout bounds each attempt, zero means no limit. Stores and
+	// retrieves only count the time spent connecting and waiting for the
+	// response, not the transfer, see attempt.
+	AttemptTimeout time.Duration
+}
+
+// WithRetry retries the operations of p that fail with a Retryable error,
+// waiting longer after every attempt or as long as the server asked for
+// with Retry-After.
+//
+// A store is only retried if nothing was read from src yet, or src is an
+// io.Seeker it can be rewound with. Archives streamed while they are
+// compressed can't be, so their uploads are only retried if they failed
+// before the first byte was sent. Likewise a retrieve is only retried if
+// nothing was written to dst yet. The chunk methods of a ChunkProvider are
+// retried as well, but have no contexts to time out.
+func WithRetry(p Provider, opts RetryOptions) Provider {
+	if opts.Attempts < 1 {
+		opts.Attempts = 1
+	}
+	r := &retryProvider{p: p, opts: opts}
+	if cp, ok := p.(ChunkProvider); ok {
+		return &retryChunkProvider{retryProvider: r, cp: cp}
+	}
+	return r
+}
+
+type retryProvider struct {
+	p    Provider
+	opts RetryOptions
+}
+
+// errAttemptTimeout is the cause of an attempt cancelled by AttemptTimeout.
+var errAttemptTimeout = errors.New("attempt timed out")
+
+// attempt is the timeout of a single attempt. It's paused while data is
+// transferred, so AttemptTimeout bounds connecting and waiting for the
+// response, but not how long a large archive takes to send.
+type attempt struct {
+	// timer cancels the attempt, nil without a timeout
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (a *attempt) pause() {
+	if a != nil && a.timer != nil {
+		a.timer.Stop()
+	}
+}
+
+func (a *attempt) resume() {
+	if a != nil && a.timer != nil {
+		a.timer.Reset(a.timeout)
+	}
+}
+
+// do runs fn until it succeeds, fails permanently or runs out of attempts.
+// canRetry is asked before every retry whether the operation can be repeated
+// at all.
+func (r *retryProvider) do(ctx context.Context, op, id string, canRetry func() bool, fn func(ctx context.Context, a *attempt) error) error {
+	for n := 1; ; n++ {
+		metricAttempts.Add(op, 1)
+
+		actx, cancel := context.WithCancelCause(ctx)
+		a := &attempt{timeout: r.opts.AttemptTimeout}
+		if a.timeout > 0 {
+			a.timer = time.AfterFunc(a.timeout, func() { cancel(errAttemptTimeout) })
+		}
+		err := fn(actx, a)
+		a.pause()
+		timedOut := context.Cause(actx) == errAttemptTimeout
+		cancel(nil)
+
+		// An attempt that timed out on its own is worth another try
+		if err != nil && ctx.Err() == nil && (timedOut || errors.Is(err, context.DeadlineExceeded)) {
+			err = &Error{Op: op, ID: id, Kind: ErrUnavailable, Err: err}
+		}
+		if err == nil || !Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if n >= r.opts.Attempts || (canRetry != nil && !canRetry()) {
+			metricFailures.Add(op, 1)
+			if n > 1 {
+				log.Error("Storage operation failed after retries", "op", op, "id", id, "attempts", n, "error", err)
+			}
+			return err
+		}
+
+		delay := r.delay(n, err)
+		metricRetries.Add(op, 1)
+		log.Warn("Retrying storage operation", "op", op, "id", id, "attempt", n, "delay", delay, "error", err)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// delay is the jittered exponential backoff after attempt, or the
+// Retry-After of err if the server sent one. Both are capped at MaxDelay.
+func (r *retryProvider) delay(attempt int, err error) time.Duration {
+	var serr *Error
+	if errors.As(err, &serr) && serr.RetryAfter > 0 {
+		return min(serr.RetryAfter, r.opts.MaxDelay)
+	}
+
+	d := r.opts.BaseDelay << (attempt - 1)
+	if d <= 0 || d > r.opts.MaxDelay {
+		d = r.opts.MaxDelay
+	}
+	// Equal jitter: half fixed, half random
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+func (r *retryProvider) Store(ctx context.Context, id string, src io.Reader) error {
+	cr := &countingReader{r: src}
+	start, seekErr := int64(0), error(nil)
+	seeker, canSeek := src.(io.Seeker)
+	if canSeek {
+		start, seekErr = seeker.Seek(0, io.SeekCurrent)
+		canSeek = seekErr == nil
+	}
+
+	rewind := func() bool {
+		if cr.n == 0 {
+			return true
+		}
+		if !canSeek {
+			return false
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return false
+		}
+		cr.n = 0
+		return true
+	}
+	return r.do(ctx, "store", id, rewind, func(ctx context.Context, a *attempt) error {
+		cr.a = a
+		return r.p.Store(ctx, id, cr)
+	})
+}
+
+func (r *retryProvider) Retrieve(ctx context.Context, id string, dst io.Writer) error {
+	cw := &countingWriter{w: dst}
+	untouched := func() bool { return cw.n == 0 }
+	return r.do(ctx, "retrieve", id, untouched, func(ctx context.Context, a *attempt) error {
+		cw.a = a
+		return r.p.Retrieve(ctx, id, cw)
+	})
+}
+
+func (r *retryProvider) RetrieveIfChanged(ctx context.Context, id, version string, dst io.Writer) (string, error) {
+	cw := &countingWriter{w: dst}
+	untouched := func() bool { return cw.n == 0 }
+	var got string
+	err := r.do(ctx, "retrieve", id, untouched, func(ctx context.Context, a *attempt) (err error) {
+		cw.a = a
+		got, err = RetrieveIfChanged(ctx, r.p, id, version, cw)
+		return err
+	})
+	return got, err
+}
+
+func (r *retryProvider) Stat(ctx context.Context, id string) (Object, error) {
+	var obj Object
+	err := r.do(ctx, "stat", id, nil, func(ctx context.Context, _ *attempt) (err error) {
+		obj, err = r.p.Stat(ctx, id)
+		return err
+	})
+	return obj, err
+}
+
+func (r *retryProvider) Delete(ctx context.Context, id string) error {
+	return r.do(ctx, "delete", id, nil, func(ctx context.Context, _ *attempt) error {
+		return r.p.Delete(ctx, id)
+	})
+}
+
+func (r *retryProvider) List(ctx context.Context) ([]Object, error) {
+	var objs []Object
+	err := r.do(ctx, "list", "", nil, func(ctx context.Context, _ *attempt) (err error) {
+		objs, err = r.p.List(ctx)
+		return err
+	})
+	return objs, err
+}
+
+type retryChunkProvider struct {
+	*retryProvider
+	cp ChunkProvider
+}
+
+func (r *retryChunkProvider) HasChunk(sum string) (bool, error) {
+	var ok bool
+	err := r.do(context.Background(), "check chunk", sum, nil, func(context.Context, *attempt) (err error) {
+		ok, err = r.cp.HasChunk(sum)
+		return err
+	})
+	return ok, err
+}
+
+func (r *retryChunkProvider) StoreChunk(sum string, src io.Reader) error {
+	// Chunks are small and always uploaded from memory
+	seeker, canSeek := src.(io.Seeker)
+	rewind := func() bool {
+		if !canSeek {
+			return false
+		}
+		_, err := seeker.Seek(0, io.SeekStart)
+		return err == nil
+	}
+	return r.do(context.Background(), "store chunk", sum, rewind, func(context.Context, *attempt) error {
+		return r.cp.StoreChunk(sum, src)
+	})
+}
+
+func (r *retryChunkProvider) RetrieveChunk(sum string, dst io.Writer) error {
+	cw := &countingWriter{w: dst}
+	untouched := func() bool { return cw.n == 0 }
+	return r.do(context.Background(), "retrieve chunk", sum, untouched, func(context.Context, *attempt) error {
+		return r.cp.RetrieveChunk(sum, cw)
+	})
+}
+
+// countingReader pauses the timeout of its attempt while the upload is sent,
+// and resumes it for the response once it's all read.
+type countingReader struct {
+	r io.Reader
+	n int64
+	a *attempt
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if n > 0 {
+		c.a.pause()
+	}
+	if err == io.EOF {
+		c.a.resume()
+	}
+	return n, err
+}
+
+// countingWriter pauses the timeout of its attempt once the download starts.
+type countingWriter struct {
+	w io.Writer
+	n int64
+	a *attempt
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if n > 0 {
+		c.a.pause()
+	}
+	return n, err
+}
@@ -1,8 +1,74 @@
 package storage
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
 
+// Object describes a stored archive.
+type Object struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+	// Checksum is the hex encoded sha256 sum of the contents, empty if the
+	// provider doesn't know it
+	Checksum string `json:",omitempty"`
+	// Version changes every time the object is stored
+	Version string
+}
+
+// Provider stores the archives of the volumes, addressed by server id.
+// Failures are reported as an *Error, missing archives as ErrNotFound.
 type Provider interface {
+	Store(ctx context.Context, id string, src io.Reader) error
+	Retrieve(ctx context.Context, id string, dst io.Writer) error
+	Stat(ctx context.Context, id string) (Object, error)
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]Object, error)
+}
+
+// ConditionalRetriever is implemented by providers that can skip sending an
+// archive that didn't change in a single request, see RetrieveIfChanged.
+type ConditionalRetriever interface {
+	RetrieveIfChanged(ctx context.Context, id, version string, dst io.Writer) (string, error)
+}
+
+// RetrieveIfChanged retrieves the archive id into dst, unless its version is
+// still version, in which case it returns ErrNotModified and leaves dst
+// alone. An empty version always retrieves. It returns the version that was
+// retrieved, empty if the provider can't tell.
+//
+// Providers that don't implement ConditionalRetriever are asked with Stat
+// first, and always retrieve if they don't support it.
+func RetrieveIfChanged(ctx context.Context, p Provider, id, version string, dst io.Writer) (string, error) {
+	if cr, ok := p.(ConditionalRetriever); ok {
+		return cr.RetrieveIfChanged(ctx, id, version, dst)
+	}
+
+	obj, err := p.Stat(ctx, id)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return "", err
+	}
+	if version != "" && obj.Version == version {
+		return version, &Error{Op: "retrieve", ID: id, Kind: ErrNotModified}
+	}
+	return obj.Version, p.Retrieve(ctx, id, dst)
+}
+
+// LegacyProvider is the original provider interface, without contexts or
+// metadata. Wrap implementations with Legacy to use them as a Provider.
+type LegacyProvider interface {
 	Store(id string, src io.Reader) error
 	Retrieve(id string, dst io.Writer) error
 }
+
+// ChunkProvider is implemented by providers that support chunked backups.
+// Chunks are addressed by the hex encoded sha256 sum of their contents.
+type ChunkProvider interface {
+	Provider
+	HasChunk(sum string) (bool, error)
+	StoreChunk(sum string, src io.Reader) error
+	RetrieveChunk(sum string, dst io.Writer) error
+}
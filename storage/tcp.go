@@ -2,17 +2,42 @@ package storage
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type tcpStorage struct {
 	endpoint *url.URL
+	dialer   net.Dialer
+}
+
+func init() {
+	Register(Backend{
+		Schemes: []string{"tcp"},
+		Options: map[string]string{
+			"timeout": "Limit on connecting to the storage server, e.g. 10s",
+		},
+		New: func(ep *url.URL) (Provider, error) {
+			ts := &tcpStorage{endpoint: ep}
+			if v := ep.Query().Get("timeout"); v != "" {
+				timeout, err := time.ParseDuration(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid timeout %q: %w", v, err)
+				}
+				ts.dialer.Timeout = timeout
+			}
+			return ts, nil
+		},
+	})
 }
 
 func NewTCPStorage(endpoint string) (Provider, error) {
@@ -26,46 +51,145 @@ func NewTCPStorage(endpoint string) (Provider, error) {
 	}, nil
 }
 
-func (ts *tcpStorage) Store(id string, src io.Reader) error {
-	conn, err := net.Dial("tcp", ts.endpoint.Host)
+// tcpConn is a connection to the TCP storage server, see server/tcp for the
+// protocol. It's closed when ctx is done, which aborts any read or write.
+type tcpConn struct {
+	*net.TCPConn
+	r    *bufio.Reader
+	stop func() bool
+
+	ctx    context.Context
+	op, id string
+}
+
+func (ts *tcpStorage) dial(ctx context.Context, cmd, id string) (*tcpConn, error) {
+	op := strings.ToLower(cmd)
+	conn, err := ts.dialer.DialContext(ctx, "tcp", ts.endpoint.Host)
 	if err != nil {
-		return err
+		return nil, wrap(op, id, err)
 	}
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
-		tcpConn.SetReadBuffer(65536)
-		tcpConn.SetWriteBuffer(65536)
+	tcp := conn.(*net.TCPConn)
+	tcp.SetNoDelay(true)
+	tcp.SetReadBuffer(65536)
+	tcp.SetWriteBuffer(65536)
+
+	c := &tcpConn{
+		TCPConn: tcp,
+		r:       bufio.NewReader(tcp),
+		stop:    context.AfterFunc(ctx, func() { tcp.Close() }),
+		ctx:     ctx,
+		op:      op,
+		id:      id,
+	}
+	if _, err := fmt.Fprintf(c, "%s:%s\n", cmd, id); err != nil {
+		c.Close()
+		return nil, c.wrap(err)
+	}
+	return c, nil
+}
+
+// wrap turns err into an *Error. A closed connection is the context's doing
+// if it's done.
+func (c *tcpConn) wrap(err error) error {
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return wrap(c.op, c.id, err)
+}
+
+func (c *tcpConn) Close() error {
+	c.stop()
+	return c.TCPConn.Close()
+}
+
+// status reads the status line of the response.
+func (c *tcpConn) status() error {
+	res, err := c.r.ReadString('\n')
+	switch {
+	case res == "OK\n":
+		return nil
+	case res == "NOTFOUND\n":
+		return &Error{Op: c.op, ID: c.id, Kind: ErrNotFound}
+	case err != nil:
+		logrus.WithField("error", err).Infof("couldn't %s over tcp", c.op)
+		return c.wrap(err)
+	case strings.HasPrefix(res, "ERROR "):
+		return &Error{Op: c.op, ID: c.id, Err: errors.New(strings.TrimSpace(strings.TrimPrefix(res, "ERROR ")))}
+	}
+	return &Error{Op: c.op, ID: c.id, Kind: ErrCorrupt, Err: fmt.Errorf("unexpected response %q", strings.TrimSpace(res))}
+}
+
+func (ts *tcpStorage) Store(ctx context.Context, id string, src io.Reader) error {
+	conn, err := ts.dial(ctx, "STORE", id)
+	if err != nil {
+		return err
 	}
 	defer conn.Close()
-	fmt.Fprintf(conn, "STORE:%s\n", id)
-	_, err = io.Copy(conn, src)
+
+	if _, err := io.Copy(conn, src); err != nil {
+		return conn.wrap(err)
+	}
+	// The server reads until EOF before it answers
+	if err := conn.CloseWrite(); err != nil {
+		return conn.wrap(err)
+	}
+	return conn.status()
+}
+
+func (ts *tcpStorage) Retrieve(ctx context.Context, id string, dst io.Writer) error {
+	conn, err := ts.dial(ctx, "RETRIEVE", id)
 	if err != nil {
 		return err
 	}
-	res, err := bufio.NewReader(conn).ReadString('\n')
-	if err != nil || res != "OK\n" {
-		logrus.WithField("error", err).Info("couldn't store over tcp")
-		return errors.New("failed to store over TCP")
+	defer conn.Close()
+
+	if err := conn.status(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, conn.r); err != nil {
+		return conn.wrap(err)
 	}
 	return nil
 }
 
-func (ts *tcpStorage) Retrieve(id string, dst io.Writer) error {
-	conn, err := net.Dial("tcp", ts.endpoint.Host)
+func (ts *tcpStorage) Stat(ctx context.Context, id string) (Object, error) {
+	var obj Object
+	err := ts.query(ctx, "STAT", id, &obj)
+	return obj, err
+}
+
+func (ts *tcpStorage) Delete(ctx context.Context, id string) error {
+	conn, err := ts.dial(ctx, "DELETE", id)
 	if err != nil {
 		return err
 	}
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetReadBuffer(65536)
-		tcpConn.SetWriteBuffer(65536)
+	defer conn.Close()
+	return conn.status()
+}
+
+func (ts *tcpStorage) List(ctx context.Context) ([]Object, error) {
+	var objs []Object
+	err := ts.query(ctx, "LIST", "", &objs)
+	return objs, err
+}
+
+// query sends a command answered with a line of JSON.
+func (ts *tcpStorage) query(ctx context.Context, cmd, id string, v any) error {
+	conn, err := ts.dial(ctx, cmd, id)
+	if err != nil {
+		return err
 	}
 	defer conn.Close()
-	fmt.Fprintf(conn, "RETRIEVE:%s\n", id)
-	res, err := bufio.NewReader(conn).ReadString('\n')
-	if err != nil || res != "OK\n" {
-		logrus.WithField("error", err).Info("couldn't retrieve over tcp")
-		return errors.New("failed to retrieve over TCP")
-	}
-	_, err = io.Copy(dst, conn)
-	return err
+
+	if err := conn.status(); err != nil {
+		return err
+	}
+	line, err := conn.r.ReadBytes('\n')
+	if err != nil {
+		return conn.wrap(err)
+	}
+	if err := json.Unmarshal(line, v); err != nil {
+		return &Error{Op: conn.op, ID: id, Kind: ErrCorrupt, Err: err}
+	}
+	return nil
 }